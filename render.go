@@ -7,6 +7,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -22,7 +26,31 @@ func replace(text string, original string, substitution string, numReplacements
 	return newText, nil
 }
 
+var buildReasonAssignment = regexp.MustCompile(`BUILD_REASON="(?:\$BUILD_REASON )?'([^'"]*)'"`)
+
+// The args.gn that the upstream build_chromium writes, and the version code
+// it writes it with, which chromium_args_gn takes over.
+var (
+	upstreamArgsGN         = regexp.MustCompile(`(?s)cat <<EOF > out/Default/args\.gn\n(.*?\n)EOF\n`)
+	upstreamDefaultVersion = regexp.MustCompile(`\n\s*(DEFAULT_VERSION=[^\n]*)\n`)
+	shellVariable          = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
 func alterTemplate(txt string) (string, error) {
+	argsGN := upstreamArgsGN.FindStringSubmatch(txt)
+	if argsGN == nil {
+		return "", fmt.Errorf("The upstream build_chromium no longer writes args.gn as\n%s", upstreamArgsGN)
+	}
+	for _, v := range shellVariable.FindAllStringSubmatch(argsGN[1], -1) {
+		if v[1] != "CHROMIUM_REVISION" && v[1] != "DEFAULT_VERSION" {
+			return "", fmt.Errorf("The upstream args.gn of Chromium uses $%s, which chromium_args_gn does not set", v[1])
+		}
+	}
+	defaultVersion := upstreamDefaultVersion.FindStringSubmatch(txt)
+	if defaultVersion == nil {
+		return "", fmt.Errorf("The upstream build_chromium no longer assigns DEFAULT_VERSION as\n%s", upstreamDefaultVersion)
+	}
+
 	var replacements = []struct {
 		original        string
 		substitution    string
@@ -36,6 +64,40 @@ if [ -n "$BASH_TRACE" ] ; then
 	exec 19> "$BASH_TRACE"
 	BASH_XTRACEFD=19
 fi
+if [ -n "$BUILD_EVENTS" ] ; then
+	exec 18>> "$BUILD_EVENTS"
+	BUILD_EVENTS_FD=18
+fi
+# The renderer that generated this script, for its helper subcommands.
+RENDER_HELPER="${RENDER_HELPER:-$(dirname "$(readlink -f "$0")")/render}"
+
+# Stage selection options; the remaining arguments are left for the stack.
+FROM_STAGE=
+TO_STAGE=
+ONLY_STAGE=
+stack_args=()
+while [ "$#" -gt 0 ] ; do
+	case "$1" in
+		--from-stage|--to-stage|--only-stage)
+			if [ "$#" -lt 2 ] ; then
+				echo "Option $1 requires a stage name." >&2
+				exit 64
+			fi
+			case "$1" in
+				--from-stage) FROM_STAGE="$2" ;;
+				--to-stage) TO_STAGE="$2" ;;
+				--only-stage) ONLY_STAGE="$2" ;;
+			esac
+			shift 2
+			;;
+		--from-stage=*) FROM_STAGE="${1#*=}" ; shift ;;
+		--to-stage=*) TO_STAGE="${1#*=}" ; shift ;;
+		--only-stage=*) ONLY_STAGE="${1#*=}" ; shift ;;
+		*) stack_args+=("$1") ; shift ;;
+	esac
+done
+set -- "${stack_args[@]}"
+unset stack_args
 set -x
 `,
 			-1,
@@ -57,15 +119,22 @@ set -x
 			`message="No build is required, but FORCE_BUILD=true"
       echo "$message"
 `, `aws_notify "No build is required, but FORCE_BUILD=true"
+      emit_event build_check needed false forced FORCE_BUILD
 `, -1,
 		},
 		{
 			`message="No build is required, but IGNORE_VERSION_CHECKS=true"
       echo "$message"
 `, `aws_notify "No build is required, but IGNORE_VERSION_CHECKS=true"
+      emit_event build_check needed false forced IGNORE_VERSION_CHECKS
 `, -1,
 		},
-		{`echo "New build is required"`, `aws_notify "New build is required"`, -1},
+		{
+			`echo "New build is required"`,
+			`aws_notify "New build is required"
+    emit_event build_check needed true reason "$BUILD_REASON"`,
+			-1,
+		},
 		{
 			`BUILD_TYPE="user"`,
 			`BUILD_TYPE="<% .BuildType %>"`,
@@ -82,7 +151,16 @@ set -x
 		{`"${INSTANCE_TYPE}" "${INSTANCE_REGION}" "${INSTANCE_IP}" `, "", -1},
 		{
 			`repo init --manifest-url "$MANIFEST_URL" --manifest-branch "$AOSP_BRANCH" --depth 1 || true`,
-			`repo init --manifest-url "$MANIFEST_URL" --manifest-branch "$AOSP_BRANCH" --depth 1
+			`repo init --manifest-url "$MANIFEST_URL" --manifest-branch "$AOSP_BRANCH" --depth 1 "${REPO_REFERENCE_ARGS[@]}" || {
+    # Without a mirror, a failure is ignored, as upstream ignores it.  With
+    # one, going on would sync whatever manifest the last build left in
+    # .repo.
+    if [ -n "${REPO_REFERENCE}" ] ; then
+      log "repo init failed with the mirror ${REPO_REFERENCE}"
+      return 1
+    fi
+  }
+  verify_sources -name "AOSP manifest" -dir "${BUILD_DIR}/.repo/manifests" -tag "$AOSP_BRANCH"
   quiet gitcleansources`,
 			-1,
 		},
@@ -101,17 +179,20 @@ set -x
 		},
 		{
 			`cp out/Default/apks/MonochromePublic.apk ${BUILD_DIR}/external/chromium/prebuilt/arm64/`,
-			`aws s3 cp out/Default/apks/MonochromePublic.apk "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk"`,
+			`aws s3 cp out/Default/apks/MonochromePublic.apk "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk"
+  chromium_cache put out/Default/apks/MonochromePublic.apk`,
 			-1,
 		},
 		{
 			`> out/Default/args.gn`,
-			`> out/Default/args.gn.new`,
+			`> /dev/null`,
 			-1,
 		},
 		{
 			`gn gen out/Default`,
-			`if ! cmp out/Default/args.gn out/Default/args.gn.new ; then
+			`# The arguments are those the Chromium cache key was computed from.
+  chromium_args_gn > out/Default/args.gn.new
+  if ! cmp out/Default/args.gn out/Default/args.gn.new ; then
     mv -f out/Default/args.gn.new out/Default/args.gn
   else
     rm -f out/Default/args.gn.new
@@ -127,7 +208,8 @@ set -x
 		},
 		{
 			`aws s3 cp "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" ${BUILD_DIR}/external/chromium/prebuilt/arm64/`,
-			`# Suppressed copy from S3 to external/prebuilt/arm64/ as this happens later`,
+			`# Suppressed copy from S3 to external/prebuilt/arm64/ as this happens later
+    emit_event chromium action reuse revision "$current"`,
 			-1,
 		},
 		{
@@ -162,8 +244,14 @@ set -x
   test -d src -a -f .fetched && {
     # Fetched?  Just git fetch to get the latest versions.
     cd src
-    git fetch --tags
+    if [ -z "${SOURCE_BUNDLE}" ] ; then
+      git fetch --tags
+    fi
   } || {
+    if [ -n "${SOURCE_BUNDLE}" ] ; then
+      echo "The source bundle has no Chromium source tree, and fetching it needs network access." >&2
+      return 1
+    fi
     # Not fetched?  Start over.  This prevents errors when fetch is interrupted.
     echo "The Chromium source tree has never been fetched or failed halfway.  Starting the fetch over."
     rm -rf src out/Default .depsrev .cipd .gclient .gclient_entries
@@ -175,12 +263,18 @@ set -x
 		},
 		{
 			`build_chromium() {`,
-			`fetch_chromium() {`,
+			`fetch_chromium() {
+  if chromium_reusable ; then
+    log "Chromium $LATEST_CHROMIUM is in the Chromium cache, not fetching it"
+    return 0
+  fi
+`,
 			-1,
 		},
 		{
 			`build_chromium $LATEST_CHROMIUM`,
-			`# disable call to build_chromium`,
+			`# disable call to build_chromium
+    emit_event chromium action build revision "$LATEST_CHROMIUM"`,
 			-1,
 		},
 		{
@@ -211,12 +305,20 @@ set -x
   # reset any modifications
   git checkout -- .
 `,
-			`# checkout specific revision
+			`# take the patches of the last build out before checking out
+  unapply_chromium_patches
+
+  # checkout specific revision
   git checkout "$CHROMIUM_REVISION" -f
+  verify_sources -name Chromium -dir "$HOME/chromium/src" -tag "$CHROMIUM_REVISION"
 
   # Determine if we need a clean source tree and new build based on changed revision.
   currdepsrev=$(git rev-parse HEAD || true)
   formerdepsrev=$(cat ../.depsrev || true)
+  if [ "$currdepsrev" != "$formerdepsrev" ] && [ -n "${SOURCE_BUNDLE}" ] ; then
+      echo "The Chromium source tree in the source bundle is not synced to $CHROMIUM_REVISION, and syncing it needs network access." >&2
+      return 1
+  fi
   if [ "$currdepsrev" != "$formerdepsrev" ] ; then
       # New rev.  Third party tooling probably changed.  Will lead to invalid build.  Nuke the build and reinstall the dependencies.
       echo "Revision of Chromium has changed from $formerdepsrev to $currdepsrev.  Nuking third-party and build products."
@@ -248,15 +350,22 @@ set -x
 }
 
 build_chromium() {
-  cd $HOME/chromium/src
-
   log_header ${FUNCNAME}
 
+  if chromium_reusable ; then
+    log "Chromium $LATEST_CHROMIUM is in the Chromium cache, not building it"
+    return 0
+  fi
+
+  cd $HOME/chromium/src
+
   CHROMIUM_REVISION=${LATEST_CHROMIUM}
   DEFAULT_VERSION=$(echo $CHROMIUM_REVISION | awk -F"." '{ printf "%s%03d52\n",$3,$4}')
 
   export PATH="$PATH:$HOME/depot_tools"
 
+  apply_chromium_patches
+
 `,
 			-1,
 		},
@@ -268,7 +377,12 @@ build_chromium() {
 		},
 		{
 			`retry git clone`,
-			`retry gitavoidreclone`,
+			`fetch_and_verify`,
+			-1,
+		},
+		{
+			`. ${scripts_dir}/`,
+			`run_custom_script ${scripts_dir}/`,
 			-1,
 		},
 		{
@@ -330,21 +444,37 @@ MARLIN_KERNEL_OUT_DIR="$HOME/kernel-out/$DEVICE"`,
 			`# make modifications to default AOSP
   # Since we just git cleaned everything, we will have to re-copy
   # the MonochromePublic.apk file from S3.
-  mkdir -p ${BUILD_DIR}/external/chromium/prebuilt/arm64
-  aws s3 cp "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" ${BUILD_DIR}/external/chromium/prebuilt/arm64/MonochromePublic.apk
+  if [ "${BUILD_CHROMIUM}" == "true" ] ; then
+    mkdir -p ${BUILD_DIR}/external/chromium/prebuilt/arm64
+    aws s3 cp "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" ${BUILD_DIR}/external/chromium/prebuilt/arm64/MonochromePublic.apk
+  elif [ -n "${BROWSER_APK}" ] ; then
+    # A prebuilt browser takes the place of the one we would have built.
+    mkdir -p ${BUILD_DIR}/external/chromium/prebuilt/arm64
+    cp -f "${BROWSER_APK}" ${BUILD_DIR}/external/chromium/prebuilt/arm64/MonochromePublic.apk
+  fi
   `,
 			-1,
 		},
 		{
 			`timeout 30m "${BUILD_DIR}/vendor/android-prepare-vendor/execute-all.sh" --debugfs --keep --yes --device "${DEVICE}" --buildID "${AOSP_BUILD}" --output "${BUILD_DIR}/vendor/android-prepare-vendor"`,
 			`mkdir -p "${HOME}/vendor-in"
-  local flag="${HOME}/vendor-in/.${DEVICE}-$(tr '[:upper:]' '[:lower:]' <<< "${AOSP_BUILD}")"
-  if test -f "${flag}" ; then
-    true
-  else
-    timeout 30m "${BUILD_DIR}/vendor/android-prepare-vendor/execute-all.sh" --fuse-ext2 --yes --device "${DEVICE}" --buildID "${AOSP_BUILD}" --output "${HOME}/vendor-in"
-    touch "${flag}"
-  fi`,
+  local build_id="$(tr '[:upper:]' '[:lower:]' <<< "${AOSP_BUILD}")"
+  # Extracted vendor files are only trusted if they match the manifest
+  # recorded once their extraction succeeded.
+  if ! "$RENDER_HELPER" vendor -dir "${HOME}/vendor-in" verify -device "${DEVICE}" -build "${build_id}" ; then
+    log "Vendor files for ${DEVICE} ${AOSP_BUILD} are missing or damaged -- extracting them"
+    local imgs_tar=()
+    if [ -n "${FACTORY_IMAGES_DIR}" ] ; then
+      local factory_image
+      factory_image=$(local_factory_image) || return $?
+      log "Using local factory image ${factory_image}"
+      imgs_tar=(--imgs-tar "${factory_image}")
+    fi
+    rm -rf "${HOME}/vendor-in/${DEVICE}/${build_id}"
+    timeout 30m "${BUILD_DIR}/vendor/android-prepare-vendor/execute-all.sh" --fuse-ext2 --yes --device "${DEVICE}" --buildID "${AOSP_BUILD}" --output "${HOME}/vendor-in" "${imgs_tar[@]}"
+    "$RENDER_HELPER" vendor -dir "${HOME}/vendor-in" record -device "${DEVICE}" -build "${build_id}"
+  fi
+  "$RENDER_HELPER" vendor -dir "${HOME}/vendor-in" prune -device "${DEVICE}" -current "${build_id}" -keep <% .VendorRollbackBuilds %>`,
 			-1,
 		},
 		{
@@ -380,6 +510,15 @@ MARLIN_KERNEL_OUT_DIR="$HOME/kernel-out/$DEVICE"`,
 			`"$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/${RELEASE_CHANNEL}" -)"`,
 			-1,
 		},
+		{
+			`if [ "$existing_chromium" == "$LATEST_CHROMIUM" ]; then`,
+			`if [ "${BUILD_CHROMIUM}" != "true" ]; then
+    # No browser is built from source, so a new release of Chromium is no
+    # reason to build.
+    echo "Chromium is not built for browser ${BROWSER}, not comparing its version"
+  elif [ "$existing_chromium" == "$LATEST_CHROMIUM" ]; then`,
+			1,
+		},
 		{
 			`make clobber`,
 			`# do not make clobber, verity key generation happens only once`,
@@ -388,17 +527,24 @@ MARLIN_KERNEL_OUT_DIR="$HOME/kernel-out/$DEVICE"`,
 		{
 			`# checkpoint stack version
   echo "${STACK_VERSION}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/rattlesnakeos-stack/revision"`,
-			`# checkpoint stack version
-  echo "${STACK_VERSION}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/rattlesnakeos-stack/revision"
-
-  # checkpoint target device
-  echo "${DEVICE}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/build-environment/device"
-
-  # checkpoint build type
-  echo "${BUILD_TYPE}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/build-environment/build-type"
-
-  # checkpoint custom config
-  echo "$(dumpcustomconfig)" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/build-environment/custom-config"
+			`# checkpoint this build, its inputs, versions and artifacts
+  build_state record \
+    -input device="${DEVICE}" \
+    -input build_type="${BUILD_TYPE}" \
+    -input custom_config="$(dumpcustomconfig)" \
+    -input custom_config_items="$(custom_config_items)" \
+    -input custom_config_fingerprint="$(custom_config_fingerprint)" \
+    -input browser="$(browser_identity)" \
+    -input updater="${UPDATER_IDENTITY}" \
+    -input stack_version="${STACK_VERSION}" \
+    -version aosp_build="${AOSP_BUILD}" \
+    -version aosp_branch="${AOSP_BRANCH}" \
+    -version chromium="${LATEST_CHROMIUM}" \
+    -version fdroid_client="${FDROID_CLIENT_VERSION}" \
+    -version fdroid_priv_ext="${FDROID_PRIV_EXT_VERSION}" \
+    -version custom_repos="$(custom_repo_commits)" \
+    -version build_timestamp="${BUILD_TIMESTAMP}" \
+    -artifact-list "${BUILD_ARTIFACTS}"
 `,
 			1,
 		},
@@ -413,44 +559,81 @@ MARLIN_KERNEL_OUT_DIR="$HOME/kernel-out/$DEVICE"`,
     BUILD_REASON="'Stack version $existing_stack_version != $STACK_VERSION'"
   fi
 `,
-			`  # check target device
-  existing_device=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/build-environment/device" - || true)
+			`  # bring the build state of older versions of this script along
+  build_state migrate
+
+  # check target device
+  existing_device=$(build_state get inputs.device)
   if [ "$existing_device" == "$DEVICE" ]; then
     echo "Target device ($existing_device) is up to date"
   else
     echo "Last successful build (if there was one) did not target ${DEVICE}"
     needs_update=true
-    BUILD_REASON="'Target device changed from $existing_device to $DEVICE'"
+    add_build_reason "Target device changed from $existing_device to $DEVICE"
   fi
 
   # check target build type
-  existing_build_type=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/build-environment/build-type" - || true)
+  existing_build_type=$(build_state get inputs.build_type)
   if [ "$existing_build_type" == "$BUILD_TYPE" ]; then
     echo "Build type ($existing_build_type) is the same as previous build"
   else
     echo "Last successful build (if there was one) used a build type different from ${BUILD_TYPE}"
     needs_update=true
-    BUILD_REASON="'Build type of last build changed from $existing_build_type to $BUILD_TYPE'"
+    add_build_reason "Build type of last build changed from $existing_build_type to $BUILD_TYPE"
   fi
 
-  # check target build customizations
-  existing_custom_config=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/build-environment/custom-config" - || true)
-  if [ "$existing_custom_config" == "$(dumpcustomconfig)" ]; then
+  # check target build customizations, including the contents of local
+  # custom files, the commits of custom repositories and the hosts file
+  resolve_custom_repo_commits
+  make_hosts_file || return $?
+  existing_custom_config_fingerprint=$(build_state get inputs.custom_config_fingerprint)
+  if [ "$existing_custom_config_fingerprint" == "$(custom_config_fingerprint)" ]; then
+    echo "Custom configuration ($existing_custom_config_fingerprint) is the same as previous build"
+  elif [ -z "$existing_custom_config_fingerprint" ] \
+      && [ "$(build_state get inputs.custom_config)" == "$(dumpcustomconfig)" ] \
+      && [ "$(build_state get versions.custom_repos)" == "$(custom_repo_commits)" ]; then
+    # The last build was recorded before custom configurations were
+    # fingerprinted; it is compared as it was then.
     echo "Custom configuration is the same as previous build"
   else
     echo "Last successful build used a different custom configuration"
+    custom_config_items | "$RENDER_HELPER" custom-config diff -old <(build_state get inputs.custom_config_items)
+    needs_update=true
+    add_build_reason "Custom configuration changed from last build"
+  fi
+
+  # check the browser; builds recorded before the browser could be chosen
+  # had Chromium
+  existing_browser=$(build_state get inputs.browser)
+  existing_browser="${existing_browser:-chromium}"
+  if [ "$existing_browser" == "$(browser_identity)" ]; then
+    echo "Browser ($existing_browser) is the same as previous build"
+  else
+    echo "Last successful build had a different browser"
+    needs_update=true
+    add_build_reason "Browser changed from $existing_browser to $(browser_identity)"
+  fi
+
+  # check the release channel and the Updater settings; builds recorded
+  # before they could be chosen were released to the stable channel
+  existing_updater=$(build_state get inputs.updater)
+  existing_updater="${existing_updater:-stable}"
+  if [ "$existing_updater" == "$UPDATER_IDENTITY" ]; then
+    echo "Release channel and Updater settings ($existing_updater) are the same as previous build"
+  else
+    echo "Last successful build had a different release channel or Updater settings"
     needs_update=true
-    BUILD_REASON="'Custom configuration changed from last build'"
+    add_build_reason "Release channel or Updater settings changed from $existing_updater to $UPDATER_IDENTITY"
   fi
 
   # check stack version
-  existing_stack_version=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/rattlesnakeos-stack/revision" - || true)
+  existing_stack_version=$(build_state get inputs.stack_version)
   if [ "$existing_stack_version" == "$STACK_VERSION" ]; then
     echo "Stack version ($existing_stack_version) is up to date"
   else
     echo "Last successful build (if there was one) is not with current stack version ${STACK_VERSION}"
     needs_update=true
-    BUILD_REASON="'Stack version $existing_stack_version != $STACK_VERSION'"
+    add_build_reason "Stack version $existing_stack_version != $STACK_VERSION"
   fi
 `,
 			1,
@@ -464,6 +647,13 @@ MARLIN_KERNEL_OUT_DIR="$HOME/kernel-out/$DEVICE"`,
 		}
 	}
 
+	// The remaining upstream version checks overwrite BUILD_REASON; make
+	// them accumulate every reason instead.
+	if !buildReasonAssignment.MatchString(txt) {
+		return "", fmt.Errorf("The upstream version checks no longer assign BUILD_REASON as\n%s", buildReasonAssignment)
+	}
+	txt = buildReasonAssignment.ReplaceAllString(txt, `add_build_reason "$1"`)
+
 	txt = strings.TrimSuffix(txt, "full_run\n")
 	txt = txt + `# Beginning of outright overridden functions
 
@@ -478,14 +668,17 @@ _aws() {
   out="$4"
   if [ "$func" == "sns" ]
   then
+	local message
 	if [[ $7 == --message=* ]]
 	then
-		echo "${7#--message=}" | sed 's/^/aws_notify: /' >&2
-		echo "$(dumpcustomconfig)" | sed 's/^/custom_config: /' >&2
+		message="${7#--message=}"
 	else
-		echo "$8" | sed 's/^/aws_notify: /' >&2
-		echo "$(dumpcustomconfig)" | sed 's/^/custom_config: /' >&2
+		message="$8"
 	fi
+	echo "$message" | sed 's/^/aws_notify: /' >&2
+	echo "$(dumpcustomconfig)" | sed 's/^/custom_config: /' >&2
+	_emit_event notify message "$message"
+	_emit_event custom_config text "$(dumpcustomconfig)"
   elif [ "$func" == "s3" ]
   then
 	if [ "$cmd" == "cp" ]
@@ -510,6 +703,8 @@ _aws() {
 		else
 			mkdir -p $( dirname "$out" )
 			cp -f --preserve=all "$in" "$out"
+			_emit_event artifact path "$out" source "$in"
+			echo "$out" >> "$BUILD_ARTIFACTS"
 		fi
 	elif [ "$cmd" == "ls" ]
 	then
@@ -546,21 +741,64 @@ gitavoidreclone() {
     shift
     shift
   fi
+  if [ -n "${CUSTOM_LOCAL_DIRS[$1]:-}" ] ; then
+    log "Copying local custom directory ${CUSTOM_LOCAL_DIRS[$1]} to $2"
+    mkdir -p "$2"
+    rsync -a --delete -- "$1/" "$2/"
+    return
+  fi
+  local url
+  url=$(custom_repo_url "$1")
   if test -d "$2"/.git ; then
     pushd "$2"
-    sed -i 's|url = .*|url = '"$1"'|' .git/config
+    sed -i 's|url = .*|url = '"$url"'|' .git/config
     git fetch
     git checkout origin/"$branch"
     popd
   else
     if [ "$branch" == "HEAD" ] ; then
-      git clone "$1" "$2"
+      git clone "$url" "$2"
     else
-      git clone --branch "$branch" "$1" "$2"
+      git clone --branch "$branch" "$url" "$2"
+    fi
+  fi
+  if is_custom_repo "$1" ; then
+    local commit
+    commit=$(custom_repo_commit "$1")
+    commit="${commit:-${CUSTOM_REPO_REVISIONS[$1]:-}}"
+    if [ -n "$commit" ] ; then
+      git -C "$2" cat-file -e "$commit^{commit}" 2>/dev/null || git -C "$2" fetch origin "$commit" || return $?
+      git -C "$2" checkout -f "$commit" || return $?
     fi
   fi
 }
 
+# The checkouts fetch_and_verify has made in this run, by directory, which
+# it leaves alone (and does not verify again) when asked for them again.
+declare -A FETCHED_CHECKOUTS=()
+
+# Fetches a repository with gitavoidreclone, retrying failures, and then
+# verifies the checkout once.  A checkout that does not verify would not on
+# the next try either, so verification is not retried.
+fetch_and_verify() {
+  local branch=HEAD
+  if [ "$1" == "--branch" ] ; then
+    branch="$2"
+  fi
+  local repo="${@: -2:1}"
+  local dir="${@: -1}"
+  if [ "${FETCHED_CHECKOUTS[$dir]:-}" == "$branch $repo" ] ; then
+    log "$repo is already checked out in $dir"
+    return 0
+  fi
+  retry gitavoidreclone "$@" || return $?
+  if [ -z "${CUSTOM_LOCAL_DIRS[$repo]:-}" ] && is_custom_repo "$repo" ; then
+    verify_sources -name "$repo" -dir "$dir"
+  fi
+  verify_prebuilt_apks "$repo" "$dir" || return $?
+  FETCHED_CHECKOUTS["$dir"]="$branch $repo"
+}
+
 quiet() {
 	{ set +x; } 2>/dev/null
 	local r=0
@@ -571,183 +809,754 @@ quiet() {
 	return "$r"
 }
 
-giterate() {
-	local ret=0
-	local cmd="$1"
-	shift
-	>&2 echo giterate "$@" in "$PWD"
-	for gitdir in $(find -name .git -type d) ; do
-		pushd "$gitdir/.." >/dev/null || continue
-		local d=$(dirname "$gitdir")
-		"$cmd" "$@" 2> >(sed "s|^|$d: |") || ret=$?
-		popd >/dev/null
-		if [ "$ret" != "0" ] ; then return "$ret" ; fi
-	done
+dumpcustomconfig() {
+  cat <<'CUSTOMCONFIGEOF'
+<% .CustomConfigDescription %>
+CUSTOMCONFIGEOF
 }
 
-dumpcustomconfig() {
-  local custom=
-  echo "  Custom configuration:"
-
-  <% if .CustomManifestRemotes %>
-  custom=1
-  <% range $i, $r := .CustomManifestRemotes %>
-    echo "    Remote name=<% .Name %> fetch=<% .Fetch %> revision=<% .Revision %>"
-  <% end %>
-  <% end %>
-
-  <% if .CustomManifestProjects %><% range $i, $r := .CustomManifestProjects %>
-    custom=1
-    echo "    Project path=<% .Path %> name=<% .Name %> remote=<% .Remote %>"
-  <% end %>
-  <% end %>
-
-  <% if .CustomPatches %>
-    custom=1
-  <% range $i, $r := .CustomPatches %>
-    <% range $r.Patches %>
-      echo "    Patch repo=<% $r.Repo %> patch=<% . %>"
-    <% end %>
-  <% end %>
-  <% end %>
-
-  <% if .CustomScripts %>
-    custom=1
-  <% range $i, $r := .CustomScripts %>
-    <% range $r.Scripts %>
-      echo "    Script repo=<% $r.Repo %> script=<% . %>"
-    <% end %>
-  <% end %>
-  <% end %>
-
-  <% if .CustomPrebuilts %>
-  <% range $i, $r := .CustomPrebuilts %>
-    <% range .Modules %>
-      echo "    Prebuilt repo=<% $r.Repo %> PRODUCT_PACKAGES=<% . %>"
-    <% end %>
-  <% end %>
-  <% end %>
-
-  if [ -z "$custom" ] ; then
-      echo "No custom configuration."
-  fi
-}
-
-sum() {
-  echo $(md5sum "$1" | awk ' { print $1 } ')
-}
-
-gitcleansource() {
-	local type
-	local filename
-	local sum
-	local timestamp
-	rm -f .git/timestampsums
-	while read type filename ; do
-                if [ -f "$filename" ] ; then
-                        sum=$(sum "$filename")
-                        timestamp=$(stat -c %y "$filename")
-                elif [ -e "$filename" ] ; then
-                        sum="notafilenomd5sum"
-                        timestamp=$(stat -c %y "$filename")
-                else
-                        sum="deletednomd5sum"
-                        timestamp="no time stamp"
-                fi
-                echo "$sum $timestamp $filename" >> .git/timestampsums
-	done < <(git status --ignored --porcelain)
-	if [ -f .git/timestampsums ] ; then
-		echo "has modifications" >&2
-		cat .git/timestampsums >&2
-		git clean -fxdn >&2 || return $?
-		git clean -fxd >&2 || return $?
-		git reset --hard >&2 || return $?
-	else
-                echo "does not have modifications" >&2
-        fi
+# Vendor files are extracted from factory images in this directory, rather
+# than from factory images downloaded from Google, if it is set.
+FACTORY_IMAGES_DIR=<% shellquote .FactoryImagesDir %>
+FACTORY_IMAGES_SHA256SUMS=<% shellquote .FactoryImagesSHA256Sums %>
+
+# Prints the local factory image for this device and AOSP build, and fails
+# if there is none or it does not have the expected SHA-256 hash.
+local_factory_image() {
+  local sums=()
+  if [ -n "${FACTORY_IMAGES_SHA256SUMS}" ] ; then
+    sums=(-sha256sums "${FACTORY_IMAGES_SHA256SUMS}")
+  fi
+  "$RENDER_HELPER" factory-image -dir "${FACTORY_IMAGES_DIR}" "${sums[@]}" -device "${DEVICE}" -build "${AOSP_BUILD}"
 }
 
-gitrestoretimestamp() {
-	local sum
-	local date
-	local time
-	local timezone
-	local filename
-	local timestamp
-	local actualsum
-	local actualtimestamp
-	test -f .git/timestampsums || {
-                echo "time restore: nothing to restore" >&2
-                return 0
-        }
-	while read sum date time timezone filename ; do
-		# If the file does not exist or is not a file,
-		# don't bother restoring the timestamp
-		test -f "$filename" || {
-                    echo "time restore: $filename does not exist" >&2
-                    continue
-                }
-		timestamp="$date $time $timezone"
-		actualsum=$(sum "$filename")
-		actualtimestamp=$(stat -c %y "$filename")
-		# If the file has changed, it has earned its mtime.
-		if [ "$sum" != "$actualsum" ] ; then
-                    echo "time restore: $filename sum differs" >&2
-                    continue
-                fi
-		# If the file says "no time stamp", the file did not exist,
-		# cannot restore timestamp.
-		if [ "$timestamp" == "no time stamp" ] ; then
-                    echo "time restore: $filename has no timestamp" >&2
-                    continue
-                fi
-		# If the file has the same time stamp as before,
-		# don't bother restoring it.
-		if [ "$timestamp" == "$actualtimestamp" ] ; then
-                    echo "time restore: $filename has kept its timestamp" >&2
-                    continue
-                fi
-		echo "time restore: $filename unchanged, mtime differs, restoring" >&2
-		touch -d "$timestamp" "$filename"
-	done < <(cat .git/timestampsums)
-}
-
-savetimestamp() {
-	local type
-	local filename
-	local sum
-	local timestamp
-	rm -f .timestampsums
-	while read filename ; do
-                if [ "$filename" == ".timestampsums" -o "$filename" == "./.timestampsums" ] ; then
-                    continue
-                fi
-                if [ -f "$filename" ] ; then
-                        sum=$(sum "$filename")
-                        timestamp=$(stat -c %y "$filename")
-                elif [ -e "$filename" ] ; then
-                        sum="notafilenomd5sum"
-                        timestamp=$(stat -c %y "$filename")
-                else
-                        sum="deletednomd5sum"
-                        timestamp="no time stamp"
-                fi
-                echo "$sum $timestamp $filename" >> .timestampsums
-	done < <(find)
-	if [ -f .timestampsums ] ; then
-		echo "has modifications" >&2
-		wc -l .timestampsums >&2
-	else
-                echo "does not have modifications" >&2
-        fi
+# Git fetches from URLs that start with the original of a rewrite rule
+# fetch from its replacement instead (url.<replacement>.insteadOf).  The
+# rules apply to every git command the build runs, including those that
+# repo runs for the AOSP manifest and projects and custom manifest remotes.
+URL_REWRITES=<% shellquote .GitConfigParameters %>
+if [ -n "${URL_REWRITES}" ] ; then
+  export GIT_CONFIG_PARAMETERS="${GIT_CONFIG_PARAMETERS:+$GIT_CONFIG_PARAMETERS }${URL_REWRITES}"
+fi
+
+# repo init borrows the objects of AOSP projects from this local mirror
+# (made with repo init --mirror), if it is set, rather than fetching them.
+REPO_REFERENCE=<% shellquote .RepoReference %>
+REPO_REFERENCE_ARGS=()
+if [ -n "${REPO_REFERENCE}" ] ; then
+  REPO_REFERENCE_ARGS=(--reference "${REPO_REFERENCE}")
+fi
+
+# Fetched sources (the AOSP manifest tag, the Chromium release tag, and the
+# tags or commits of custom repositories) are verified against the keys in
+# this keyring, a key file or a directory of them, if it is set.  Under the
+# enforce policy, a source that does not verify fails the build; under the
+# warn policy, it is only reported.
+VERIFY_KEYRING=<% shellquote .VerifyKeyring %>
+VERIFY_POLICY=<% shellquote .VerifyPolicy %>
+VERIFY_REPORT="$HOME/s3/interstage/verification.$JENKINS_BUILD_NUMBER.jsonl"
+CUSTOM_REPOS=(<% range .CustomRepos %><% shellquote . %> <% end %>)
+
+verify_sources() {
+  test -n "${VERIFY_KEYRING}" || return 0
+  "$RENDER_HELPER" verify -keyring "${VERIFY_KEYRING}" -policy "${VERIFY_POLICY}" -report "${VERIFY_REPORT}" check -stage "${CURRENT_STAGE}" "$@"
 }
 
+is_custom_repo() {
+  local repo
+  for repo in "${CUSTOM_REPOS[@]}" ; do
+    if [ "$repo" == "$1" ] ; then
+      return 0
+    fi
+  done
+  return 1
+}
+
+# The revisions (commits, tags or branches) custom entries are pinned to, by
+# their repository, <URL>#<revision>.
+declare -A CUSTOM_REPO_REVISIONS=(<% range $repo, $revision := .CustomRevisions %>[<% shellquote $repo %>]=<% shellquote $revision %> <% end %>)
+
+# Prints the URL of the repository of a custom entry, less the revision it
+# is pinned to.
+custom_repo_url() {
+  local revision="${CUSTOM_REPO_REVISIONS[$1]:-}"
+  if [ -n "$revision" ] ; then
+    echo "${1%"#$revision"}"
+  else
+    echo "$1"
+  fi
+}
+# The custom configuration in canonical form, and the commits of custom
+# repositories, whose fingerprint tells whether it changed since the last
+# build.  Unlike dumpcustomconfig, it covers the contents of local files.
+custom_config_items() {
+  cat <<'CUSTOMCONFIGITEMSEOF'
+<% .CustomConfigItems %>
+CUSTOMCONFIGITEMSEOF
+  local entry
+  for entry in "${CUSTOM_REPO_COMMITS[@]}" ; do
+    echo "commit ${entry#* } ${entry%% *}"
+  done
+  if [ "${#HOSTS_SOURCES[@]}" -gt 0 ] ; then
+    echo "hosts-file /system/etc/hosts $(sha256sum < "${MERGED_HOSTS_FILE}" | cut -d ' ' -f 1)"
+  fi
+}
+
+custom_config_fingerprint() {
+  custom_config_items | "$RENDER_HELPER" custom-config fingerprint
+}
+
+# Verifies the signatures of the APKs in a checkout of a custom prebuilt
+# repository, and checks them against the pins of the repository, if any.
+verify_prebuilt_apks() {
+  case "$1" in
+<% range $repo, $pins := .CustomPrebuiltPins %>    <% shellquote $repo %>)
+      log "Verifying the APKs of $1 against their pins"
+      "$RENDER_HELPER" apk-verify -dir "$2" <% $pins.Args %>
+      ;;
+<% end %>  esac
+}
+
+# The browser put in the product as the chromium module (chromium,
+# bromite, prebuilt or none), and the APK of a prebuilt one.
+BROWSER=<% shellquote .Browser %>
+BROWSER_APK=<% shellquote .BrowserAPK %>
+
+# Chromium is only built for a browser built from source, and not if the
+# custom configuration removes it from the product.
+BUILD_CHROMIUM=<% if .BuildsChromium %>true<% else %>false<% end %>
+
+# What the rebuild check compares to tell a change of browser.  Changes
+# of the version of a browser built from source are told by the version
+# of Chromium.
+browser_identity() {
+  case "${BROWSER}" in
+    prebuilt) echo "prebuilt $(sha256sum < "${BROWSER_APK}" | cut -d ' ' -f 1)" ;;
+    *) echo "${BROWSER}" ;;
+  esac
+}
+
+# The product configuration generated from the custom configuration (build
+# properties, the name and version of the OS, and resource overlays) as a
+# vendor directory of its own, or empty if there is none.
+CUSTOM_PRODUCT_DIR=<% shellquote .CustomProductDir %>
+
+# Puts the product configuration in the tree before it is synced, in a
+# directory that is not in any project, which syncing leaves alone.
+after_aosp_repo_modifications() {
+  if [ -z "${CUSTOM_PRODUCT_DIR}" ] ; then
+    rm -rf "${BUILD_DIR}/vendor/custom-config"
+    return 0
+  fi
+  log "Putting the custom product configuration in ${BUILD_DIR}/vendor/custom-config"
+  mkdir -p "${BUILD_DIR}/vendor/custom-config"
+  rsync -a --delete -- "${CUSTOM_PRODUCT_DIR}/" "${BUILD_DIR}/vendor/custom-config/"
+}
+
+# Builds are published to the file of their release channel, which the
+# Updater checks, and what the rebuild check compares to tell a change of
+# the channel or the Updater settings.
+RELEASE_CHANNEL="${DEVICE}-"<% shellquote .Updater.Channel %>
+UPDATER_IDENTITY=<% shellquote .Updater.Identity %>
+
+# The hosts files merged into the hosts file of the product (local paths or
+# URLs), and the lists of host names left out of it.  The version check
+# merges them, so that a change in the result causes a new build.
+HOSTS_SOURCES=(<% range .HostsSources %><% shellquote . %> <% end %>)
+HOSTS_ALLOWLISTS=(<% range .HostsAllowlists %><% shellquote . %> <% end %>)
+MERGED_HOSTS_FILE="$HOME/s3/interstage/hosts.$JENKINS_BUILD_NUMBER"
+
+make_hosts_file() {
+  test "${#HOSTS_SOURCES[@]}" -gt 0 || return 0
+  local args=()
+  local source allowlist
+  for source in "${HOSTS_SOURCES[@]}" ; do
+    args+=(-source "$source")
+  done
+  for allowlist in "${HOSTS_ALLOWLISTS[@]}" ; do
+    args+=(-allowlist "$allowlist")
+  done
+  log "Merging the hosts file from ${#HOSTS_SOURCES[@]} sources"
+  "$RENDER_HELPER" hosts -output "${MERGED_HOSTS_FILE}" "${args[@]}"
+}
+
+# Once the custom patches are applied, hooks the product configuration into
+# the makefile of the device, sets the defaults of settings and removes
+# packages.  Without a product configuration, this undoes what an earlier
+# build did to the tree.  The merged hosts file, if any, replaces the stock
+# one, and the Updater gets its defaults.
+after_apply_patches() {
+  log "Hooking the custom product configuration into the build"
+  "$RENDER_HELPER" product-config -tree "${BUILD_DIR}" -makefile "device/google/${DEVICE_FAMILY}/aosp_${DEVICE}.mk" <% .CustomProduct.Args %><% if .RemovesChromium %> -remove-package chromium<% end %>
+  if [ "${#HOSTS_SOURCES[@]}" -gt 0 ] ; then
+    log "Replacing the hosts file with the merged one"
+    cp -f "${MERGED_HOSTS_FILE}" "${BUILD_DIR}/system/core/rootdir/etc/hosts"
+  fi
+<% if .Updater.Args %>  log "Changing the defaults of the Updater"
+  "$RENDER_HELPER" updater-config -tree "${BUILD_DIR}" <% .Updater.Args %> || return $?
+<% end %>}
+
+# Checks that the custom patches apply to the synced tree, without applying
+# them, so that patches broken by a new AOSP build are all reported before
+# anything else is done with the tree.  The patches are fetched where
+# patch_custom applies them from, which then uses them as they are.
+check_patches() {
+  log_header ${FUNCNAME}
+  local dir="$HOME/patches"
+  local patches=()
+<% if .CustomPatches %><% range $i, $r := .CustomPatches %>  fetch_and_verify <% shellquote $r.Repo %> "$dir/<% $i %>" || return $?
+<% range $r.Patches %>  patches+=("$dir/<% $i %>/"<% shellquote . %>)
+<% end %><% end %><% end %>  if [ "${#patches[@]}" -eq 0 ] ; then
+    log "There are no custom patches to check"
+    return 0
+  fi
+  "$RENDER_HELPER" patch-check -tree "${BUILD_DIR}" "${patches[@]}"
+}
+
+# Custom scripts run in a sandbox, if this is true, that only sees the AOSP
+# tree (less the signing keys), read-write, and the system, read-only, and
+# has no network.  Otherwise, they are sourced by the build script, as they
+# were before.  Either way, the changes each one makes to the AOSP tree are
+# kept as a build artifact.
+SANDBOX_CUSTOM_SCRIPTS=<% if .SandboxCustomScripts %>true<% else %>false<% end %>
+
+run_custom_script() {
+  local script="$1"
+  local name
+  name="$(basename "$(dirname "$script")")-$(basename "$script")"
+  local snapshot="$HOME/custom-scripts-snapshot"
+  local diff="$HOME/custom-scripts-diffs/${name}.diff"
+  "$RENDER_HELPER" tree-diff -tree "${BUILD_DIR}" -dir "$snapshot" snapshot
+  if [ "${SANDBOX_CUSTOM_SCRIPTS}" == "true" ] ; then
+    local args=(
+      --unshare-user --unshare-ipc --unshare-pid --unshare-net --unshare-uts
+      --dev /dev --proc /proc --tmpfs /tmp
+    )
+    local d
+    for d in /usr /bin /sbin /lib /lib32 /lib64 /libx32 /etc ; do
+      if [ -L "$d" ] ; then
+        args+=(--symlink "$(readlink "$d")" "$d")
+      elif [ -d "$d" ] ; then
+        args+=(--ro-bind "$d" "$d")
+      fi
+    done
+    args+=(--bind "${BUILD_DIR}" "${BUILD_DIR}" --ro-bind "$(dirname "$script")" "$(dirname "$script")")
+    if [ -d "${KEYS_DIR}" ] ; then
+      args+=(--tmpfs "${KEYS_DIR}")
+    fi
+    args+=(--chdir "${BUILD_DIR}")
+    env -i PATH="$PATH" HOME=/tmp LANG=C.UTF-8 BUILD_DIR="${BUILD_DIR}" DEVICE="${DEVICE}" \
+      DEVICE_FAMILY="${DEVICE_FAMILY}" BUILD_TYPE="${BUILD_TYPE}" AOSP_BUILD="${AOSP_BUILD}" AOSP_BRANCH="${AOSP_BRANCH}" \
+      bwrap "${args[@]}" bash -e "$script" || return $?
+  else
+    . "$script"
+  fi
+  "$RENDER_HELPER" tree-diff -tree "${BUILD_DIR}" -dir "$snapshot" diff -output "$diff"
+  aws s3 cp "$diff" "s3://${AWS_RELEASE_BUCKET}/custom-scripts/${BUILD_TIMESTAMP}/${name}.diff"
+}
+
+# Local custom directories (copied to the workspace when the build script
+# was rendered) that custom entries name instead of repositories.
+declare -A CUSTOM_LOCAL_DIRS=(<% range $dir, $local := .CustomLocalDirs %>[<% shellquote $dir %>]=<% shellquote $local.Source %> <% end %>)
+# The commits custom repositories are built from, as "<commit> <repository>".
+CUSTOM_REPO_COMMITS=()
+
+# Resolves the revision every custom repository is pinned to (or its HEAD,
+# if it is not pinned) to a commit, so that the version check notices when
+# the commit changes, and the build checks out the commit that was checked.
+# A revision is a commit only if the repository has no tag or branch by
+# that name.
+resolve_custom_repo_commits() {
+  CUSTOM_REPO_COMMITS=()
+  local repo revision refs commit
+  for repo in "${CUSTOM_REPOS[@]}" ; do
+    revision="${CUSTOM_REPO_REVISIONS[$repo]:-HEAD}"
+    refs=$(git ls-remote "$(custom_repo_url "$repo")") || return $?
+    commit=$(awk -v rev="$revision" '
+      $2 == "refs/tags/" rev "^{}" { peeled = $1 }
+      $2 == rev || $2 == "refs/tags/" rev || $2 == "refs/heads/" rev { if (found == "") found = $1 }
+      END { print (peeled != "" ? peeled : found) }' <<< "$refs")
+    if [ -z "$commit" ] && [[ "$revision" =~ ^[0-9a-f]{7,40}$ ]] ; then
+      commit="$revision"
+    fi
+    if [ -z "$commit" ] ; then
+      echo "Custom repository $repo has no revision $revision." >&2
+      return 1
+    fi
+    log "Custom repository $repo is at $commit ($revision)"
+    CUSTOM_REPO_COMMITS+=("$commit $repo")
+  done
+}
+
+custom_repo_commits() {
+  if [ "${#CUSTOM_REPO_COMMITS[@]}" -gt 0 ] ; then
+    printf '%s\n' "${CUSTOM_REPO_COMMITS[@]}" | sort -k 2
+  fi
+}
+
+# Prints the commit a custom repository is built from, if it was resolved.
+custom_repo_commit() {
+  local entry
+  for entry in "${CUSTOM_REPO_COMMITS[@]}" ; do
+    if [ "${entry#* }" == "$1" ] ; then
+      echo "${entry%% *}"
+      return 0
+    fi
+  done
+}
+
+# The build runs without network access, from the sources (and with the
+# component versions) in this source bundle, if it is set.  Stages that
+# have an offline_ variant run that instead.
+SOURCE_BUNDLE=<% shellquote .SourceBundle %>
+if [ -n "${SOURCE_BUNDLE}" ] ; then
+  FACTORY_IMAGES_DIR="${FACTORY_IMAGES_DIR:-$HOME/factory-images}"
+  export DEPOT_TOOLS_UPDATE=0
+  # The repo launcher comes with the AOSP checkout.
+  export PATH="${BUILD_DIR}/.repo/repo:$PATH"
+fi
+
+# Without network access, the AOSP checkout comes from the source bundle:
+# there is no manifest to fetch, and syncing only updates the working tree.
+repo() {
+  if [ -n "${SOURCE_BUNDLE}" ] ; then
+    case "$1" in
+      init)
+        log "Using the AOSP checkout from the source bundle instead of running repo init"
+        return 0
+        ;;
+      sync)
+        shift
+        set -- sync --local-only "$@"
+        ;;
+    esac
+  fi
+  command repo "$@"
+}
+
+# Build dependencies (Debian packages) are not installed without network
+# access, and must already be present on the build machine.
+offline_setup_env() {
+  log_header "${FUNCNAME}"
+  "$RENDER_HELPER" import-sources -bundle "${SOURCE_BUNDLE}" -workspace "$HOME"
+  git config --global user.name > /dev/null || git config --global user.name "unknown"
+  git config --global user.email > /dev/null || git config --global user.email "unknown@localhost"
+}
+
+offline_get_latest_versions() {
+  log_header "${FUNCNAME}"
+  local assignments
+  assignments=$("$RENDER_HELPER" interstage -file "${SOURCE_BUNDLE}/versions.json" load -require AOSP_BUILD,AOSP_BRANCH,LATEST_CHROMIUM) || return $?
+  eval "$assignments"
+  log "Building AOSP ${AOSP_BUILD} and Chromium ${LATEST_CHROMIUM} from the source bundle ${SOURCE_BUNDLE}"
+}
+
+CHROMIUM_CACHE="${CHROMIUM_CACHE:-$HOME/chromium-cache}"
+
+BROMITE_REPO=https://github.com/bromite/bromite
+BROMITE_DIR="$HOME/bromite"
+
+# The latest release of Bromite, whose tag is the version of Chromium it
+# patches.
+latest_bromite() {
+  git ls-remote --tags --refs "${BROMITE_REPO}" | sed -n 's@.*refs/tags/\([0-9][0-9.]*\)$@\1@p' | sort -V | tail -1
+}
+
+after_get_latest_versions() {
+  # Bromite lags behind Chromium releases, so the Chromium built is the
+  # one the latest release of Bromite patches.
+  if [ "${BROWSER}" == "bromite" ] && [ -z "${SOURCE_BUNDLE}" ] ; then
+    local latest
+    latest=$(latest_bromite) || return $?
+    if [ -z "$latest" ] ; then
+      echo "Cannot find the latest release of Bromite in ${BROMITE_REPO}." >&2
+      return 1
+    fi
+    log "Bromite ${latest} is the latest release of Bromite, building Chromium ${latest}"
+    LATEST_CHROMIUM="$latest"
+  fi
+}
+
+# Checks out the release of Bromite for the Chromium about to be built.
+fetch_bromite() {
+  if ! test -d "${BROMITE_DIR}/.git" ; then
+    if [ -n "${SOURCE_BUNDLE}" ] ; then
+      echo "The source bundle has no Bromite checkout, and cloning it needs network access." >&2
+      return 1
+    fi
+    git clone "${BROMITE_REPO}" "${BROMITE_DIR}" || return $?
+  elif [ -z "${SOURCE_BUNDLE}" ] ; then
+    git -C "${BROMITE_DIR}" fetch --tags --force origin || return $?
+  fi
+  git -C "${BROMITE_DIR}" checkout -f "refs/tags/${LATEST_CHROMIUM}" || return $?
+  verify_sources -name Bromite -dir "${BROMITE_DIR}" -tag "${LATEST_CHROMIUM}"
+}
+
+# The Chromium patches of the custom configuration are fetched here.
+CHROMIUM_CUSTOM_PATCHES_DIR="$HOME/chromium-patches"
+
+fetch_chromium_custom_patches() {
+<% range $i, $r := .CustomChromium.Patches %>  fetch_and_verify <% shellquote $r.Repo %> "${CHROMIUM_CUSTOM_PATCHES_DIR}/<% $i %>" || return $?
+<% end %>  return 0
+}
+
+# The patches applied to the Chromium source tree before it is built, one
+# per line, in order: those of Bromite, if it is the browser built, then
+# those of the custom configuration.
+chromium_patches() {
+  if [ "${BROWSER}" == "bromite" ] ; then
+    sed -e '/^[[:space:]]*$/d' -e "s@^@${BROMITE_DIR}/build/patches/@" "${BROMITE_DIR}/build/bromite_patches_list.txt" || return $?
+  fi
+<% range $i, $r := .CustomChromium.Patches %><% range $r.Patches %>  echo "${CHROMIUM_CUSTOM_PATCHES_DIR}/<% $i %>/"<% shellquote . %>
+<% end %><% end %>}
+
+# The identity of the patches, empty if there are none, which is part of
+# the key of the Chromium cache.
+chromium_patches_identity() {
+  local list
+  local patches=()
+  list=$(chromium_patches) || return $?
+  if [ -n "$list" ] ; then
+    mapfile -t patches <<< "$list"
+  fi
+  "$RENDER_HELPER" patch-identity "${patches[@]}"
+}
+
+# Copies of the patches applied to the Chromium source tree, kept to take
+# them out again before the tree is checked out anew.
+CHROMIUM_APPLIED_PATCHES="$HOME/chromium/applied-patches"
+
+apply_chromium_patches() {
+  local list patch
+  local n=0
+  list=$(chromium_patches) || return $?
+  rm -rf "${CHROMIUM_APPLIED_PATCHES}"
+  mkdir -p "${CHROMIUM_APPLIED_PATCHES}"
+  while read -r patch ; do
+    test -n "$patch" || continue
+    n=$(( n + 1 ))
+    log "Applying $(basename "$patch") to Chromium"
+    git apply --whitespace=nowarn "$patch" || return $?
+    cp -f "$patch" "${CHROMIUM_APPLIED_PATCHES}/$(printf %04d "$n").patch"
+  done <<< "$list"
+}
+
+# Takes the patches applied by apply_chromium_patches out, in reverse
+# order.  If they do not come out cleanly, the source tree is reset.
+unapply_chromium_patches() {
+  local applied=()
+  local patch
+  test -d "${CHROMIUM_APPLIED_PATCHES}" || return 0
+  mapfile -t applied < <(find "${CHROMIUM_APPLIED_PATCHES}" -name '*.patch' | sort -r)
+  for patch in "${applied[@]}" ; do
+    if ! git apply -R --whitespace=nowarn "$patch" ; then
+      log "The Chromium patches of the last build do not come out cleanly -- resetting the Chromium source tree"
+      git checkout -f -- .
+      git clean -fdq
+      break
+    fi
+    rm -f "$patch"
+  done
+  rm -rf "${CHROMIUM_APPLIED_PATCHES}"
+}
+
+# The GN arguments of the custom configuration.
+CHROMIUM_CUSTOM_GN_ARGS=<% shellquote .CustomChromium.ArgsGN %>
+
+# The GN arguments Chromium is built with.  They are part of the key of the
+# Chromium cache, which check_chromium computes before any fetching.  Those
+# of Bromite come first, so that ours, which make the build one of this
+# product, take precedence, and those of the custom configuration last.
+# Ours are those of the upstream build_chromium, with the variables it
+# writes them with.
+chromium_args_gn() {
+  local CHROMIUM_REVISION="$LATEST_CHROMIUM"
+  local DEFAULT_VERSION
+  local args=()
+  if [ "${BROWSER}" == "bromite" ] ; then
+    args+=("${BROMITE_DIR}/build/GN_ARGS")
+  fi
+  UPSTREAM_DEFAULT_VERSION
+  "$RENDER_HELPER" gn-args "${args[@]}" - <(printf '%s' "${CHROMIUM_CUSTOM_GN_ARGS}") <<EOF
+UPSTREAM_ARGS_GN
+EOF
+}
+
+# Chromium pins its own compilers, so what else can make two builds of the
+# same revision differ is the host they are built on.
+chromium_toolchain_identity() {
+  if [ -n "$CHROMIUM_TOOLCHAIN_IDENTITY" ] ; then
+    echo "$CHROMIUM_TOOLCHAIN_IDENTITY"
+    return
+  fi
+  echo "$(uname -m) $(. /etc/os-release && echo "$ID $VERSION_ID") $(java -version 2>&1 | head -1)"
+}
+
+# Runs a subcommand of the Chromium cache for the Chromium about to be built.
+chromium_cache() {
+  local subcommand="$1"
+  shift
+  local args patches
+  local r=0
+  patches=$(chromium_patches_identity) || return $?
+  args=$(mktemp)
+  chromium_args_gn > "$args" || r=$?
+  if [ "$r" -eq 0 ] ; then
+    "$RENDER_HELPER" cache -dir "$CHROMIUM_CACHE" "$subcommand" -revision "$LATEST_CHROMIUM" -args "$args" -toolchain "$(chromium_toolchain_identity)" -patches "$patches" "$@" || r=$?
+  fi
+  rm -f "$args"
+  return "$r"
+}
+
+# Whether the Chromium about to be built can come from the cache instead.
+chromium_reusable() {
+  [ "$IGNORE_VERSION_CHECKS" != "true" ] && chromium_cache has
+}
+
+check_chromium() {
+  log_header ${FUNCNAME}
+
+  # The GN arguments and patches of Bromite and of the custom
+  # configuration are part of the cache key.
+  if [ "${BROWSER}" == "bromite" ] ; then
+    fetch_bromite || return $?
+  fi
+  fetch_chromium_custom_patches || return $?
+
+  if [ "$IGNORE_VERSION_CHECKS" = true ] ; then
+    log "No Chromium build is required, but IGNORE_VERSION_CHECKS=true -- building Chromium $LATEST_CHROMIUM"
+    emit_event chromium action build revision "$LATEST_CHROMIUM"
+  elif chromium_cache get -output "$HOME/s3/${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" ; then
+    log "Chromium $LATEST_CHROMIUM found in the Chromium cache"
+    emit_event chromium action reuse revision "$LATEST_CHROMIUM"
+  else
+    log "Chromium $LATEST_CHROMIUM not found in the Chromium cache -- building it"
+    emit_event chromium action build revision "$LATEST_CHROMIUM"
+  fi
+}
+
+# Records the modified, untracked and ignored files of every git checkout
+# under the current directory, then cleans the checkouts.
 gitcleansources() {
-	giterate gitcleansource "$@"
+	"$RENDER_HELPER" timestamps clean "$@"
 }
 
+# Gives the files recorded by gitcleansources their modification times
+# back, if they have come back with the same contents.
 gitrestoretimestamps() {
-	giterate gitrestoretimestamp "$@"
+	"$RENDER_HELPER" timestamps restore "$@"
+}
+
+json_quote() {
+  local s="$1"
+  s="${s//\\/\\\\}"
+  s="${s//\"/\\\"}"
+  s="${s//$'\n'/\\n}"
+  s="${s//$'\r'/\\r}"
+  s="${s//$'\t'/\\t}"
+  s="${s//[[:cntrl:]]/}"
+  printf '"%s"' "$s"
+}
+
+# Writes one JSON object per line to $BUILD_EVENTS_FD, if set.  Arguments
+# are the event type, followed by pairs of field names and values.
+# The events subcommand of render.go renders the resulting stream.
+_emit_event() {
+  test -n "$BUILD_EVENTS_FD" || return 0
+  local line="{\"time\":$(json_quote "$(date --utc +%Y-%m-%dT%H:%M:%SZ)"),\"type\":$(json_quote "$1")"
+  shift
+  while [ "$#" -gt 1 ] ; do
+    line="$line,$(json_quote "$1"):$(json_quote "$2")"
+    shift 2
+  done
+  echo "$line}" >&"$BUILD_EVENTS_FD"
+}
+
+emit_event() {
+  quiet _emit_event "$@"
+}
+
+CURRENT_STAGE=
+CURRENT_STAGE_STARTED=
+
+# Runs the stage function named by the first argument, recording its start
+# and successful end as events.  Failed stages are recorded by cleanup.
+run_stage() {
+  CURRENT_STAGE="$1"
+  CURRENT_STAGE_STARTED=$SECONDS
+  emit_event stage_start stage "$CURRENT_STAGE"
+  local stage="$1"
+  shift
+  if [ -n "${SOURCE_BUNDLE}" ] && declare -F "offline_$stage" > /dev/null ; then
+    stage="offline_$stage"
+  fi
+  "$stage" "$@"
+  # Stages may have steps of this build's own, after those of upstream.
+  if declare -F "after_$CURRENT_STAGE" > /dev/null ; then
+    "after_$CURRENT_STAGE"
+  fi
+  if [ -n "${VERIFY_KEYRING}" ] ; then
+    "$RENDER_HELPER" verify -report "${VERIFY_REPORT}" show -stage "$CURRENT_STAGE"
+  fi
+  emit_event stage_end stage "$CURRENT_STAGE" status 0 duration "$(( SECONDS - CURRENT_STAGE_STARTED ))"
+  mark_stage_done "$CURRENT_STAGE"
+  CURRENT_STAGE=
+}
+
+# The stages of a build after the version check, in order, and the stages
+# each one needs to have completed before it can run.
+BUILD_STAGES=(
+  setup_env
+  check_chromium
+  fetch_chromium
+  build_chromium
+  aosp_repo_init
+  aosp_repo_modifications
+  aosp_repo_sync
+  check_patches
+  aws_import_keys
+  attestation_setup
+  setup_vendor
+  apply_patches
+  rebuild_marlin_kernel
+  build_aosp
+  release
+  aws_upload
+  checkpoint_versions
+)
+declare -A STAGE_DEPENDENCIES=(
+  [setup_env]=""
+  [check_chromium]="setup_env"
+  [fetch_chromium]="check_chromium"
+  [build_chromium]="fetch_chromium"
+  [aosp_repo_init]="setup_env"
+  [aosp_repo_modifications]="aosp_repo_init"
+  [aosp_repo_sync]="aosp_repo_modifications"
+  [aws_import_keys]="setup_env"
+  [attestation_setup]="aosp_repo_sync"
+  [setup_vendor]="aosp_repo_sync"
+  [check_patches]="aosp_repo_sync"
+  [apply_patches]="aosp_repo_sync check_patches"
+  [rebuild_marlin_kernel]="apply_patches aws_import_keys"
+  [build_aosp]="build_chromium setup_vendor apply_patches aws_import_keys attestation_setup rebuild_marlin_kernel"
+  [release]="build_aosp"
+  [aws_upload]="release"
+  [checkpoint_versions]="aws_upload"
+)
+
+# Stage completion markers are kept per set of build inputs, so that a
+# change in any of them (e.g. a new AOSP build) starts the build over.
+CHECKPOINT_DIR=
+
+compute_checkpoint_dir() {
+  local key
+  key=$(printf '%s\n' "$DEVICE" "$BUILD_TYPE" "$STACK_VERSION" "$AOSP_BUILD" "$AOSP_BRANCH" \
+    "$LATEST_CHROMIUM" "$(browser_identity)" "$UPDATER_IDENTITY" "$FDROID_CLIENT_VERSION" "$FDROID_PRIV_EXT_VERSION" "$(custom_config_fingerprint)" | sha256sum | cut -c 1-16)
+  CHECKPOINT_DIR="$HOME/s3/interstage/checkpoints/$key"
+}
+
+mark_stage_done() {
+  test -n "$CHECKPOINT_DIR" || return 0
+  mkdir -p "$CHECKPOINT_DIR"
+  touch "$CHECKPOINT_DIR/$1"
+}
+
+stage_done() {
+  test -n "$CHECKPOINT_DIR" -a -f "$CHECKPOINT_DIR/$1"
+}
+
+# Once a build succeeds, there is nothing left to resume.
+clear_stage_checkpoints() {
+  test -n "$CHECKPOINT_DIR" || return 0
+  rm -rf "$CHECKPOINT_DIR"
+}
+
+# Stages that do not apply to this device or configuration count as done.
+stage_applies() {
+  case "$1" in
+    attestation_setup) [ "${ENABLE_ATTESTATION}" == "true" ] ;;
+    # only marlin and sailfish need kernel rebuilt so that verity_key is included
+    rebuild_marlin_kernel) [ "${DEVICE}" == "marlin" ] || [ "${DEVICE}" == "sailfish" ] ;;
+    check_chromium|fetch_chromium|build_chromium) [ "${BUILD_CHROMIUM}" == "true" ] ;;
+    *) true ;;
+  esac
+}
+
+is_build_stage() {
+  local stage
+  for stage in "${BUILD_STAGES[@]}" ; do
+    if [ "$stage" == "$1" ] ; then return 0 ; fi
+  done
+  return 1
+}
+
+# Runs the build stages selected by --from-stage, --to-stage and
+# --only-stage (all of them by default).  Without --from-stage or
+# --only-stage, stages completed by an earlier run with the same build
+# inputs are skipped.  A stage only runs once its dependencies are done.
+run_build_stages() {
+  local stage dep
+  for stage in "$FROM_STAGE" "$TO_STAGE" "$ONLY_STAGE" ; do
+    if [ -n "$stage" ] && ! is_build_stage "$stage" ; then
+      echo "Unknown stage $stage.  The stages are: ${BUILD_STAGES[*]}" >&2
+      return 64
+    fi
+  done
+  local from="$FROM_STAGE" to="$TO_STAGE"
+  if [ -n "$ONLY_STAGE" ] ; then
+    from="$ONLY_STAGE"
+    to="$ONLY_STAGE"
+  fi
+
+  local selected=false
+  if [ -z "$from" ] ; then selected=true ; fi
+  for stage in "${BUILD_STAGES[@]}" ; do
+    if [ "$stage" == "$from" ] ; then selected=true ; fi
+    if [ "$selected" == true ] && stage_applies "$stage" ; then
+      if [ -z "$from" ] && stage_done "$stage" ; then
+        log "Skipping stage $stage, already completed for these build inputs"
+        emit_event stage_skip stage "$stage" reason completed
+      else
+        for dep in ${STAGE_DEPENDENCIES[$stage]} ; do
+          if stage_applies "$dep" && ! stage_done "$dep" ; then
+            echo "Stage $stage needs stage $dep, which has not completed for these build inputs.  Run with --from-stage $dep first." >&2
+            return 65
+          fi
+        done
+        if [ "$stage" == "release" ] ; then
+          run_stage "$stage" "${DEVICE}"
+        else
+          run_stage "$stage"
+        fi
+      fi
+    fi
+    if [ "$stage" == "$to" ] ; then break ; fi
+  done
+  if [ "$stage" == "checkpoint_versions" ] && stage_done checkpoint_versions ; then
+    clear_stage_checkpoints
+    aws_notify "RattlesnakeOS Build SUCCESS"
+  fi
+}
+
+BUILD_STATE="$HOME/s3/${AWS_RELEASE_BUCKET}/build-state.json"
+# Lists the artifacts uploaded during this build, to record their hashes.
+BUILD_ARTIFACTS="$HOME/s3/interstage/artifacts.$JENKINS_BUILD_NUMBER"
+
+# Starts the list of artifacts over, unless this run resumes a build whose
+# completed stages (the release uploads among them) it skips, and whose
+# artifacts the list must keep.
+start_artifact_list() {
+  mkdir -p "$(dirname "$BUILD_ARTIFACTS")"
+  if [ -n "$CHECKPOINT_DIR" ] && [ -n "$(ls -A "$CHECKPOINT_DIR" 2>/dev/null)" ] ; then
+    return 0
+  fi
+  : > "$BUILD_ARTIFACTS"
+}
+
+build_state() {
+  local subcommand="$1"
+  shift
+  "$RENDER_HELPER" state -file "$BUILD_STATE" "$subcommand" "$@"
 }
 
 aws_logging()
@@ -759,39 +1568,73 @@ cleanup() {
   rv=$?
   if [ $rv -ne 0 ]
   then
+    if [ -n "$CURRENT_STAGE" ] ; then
+      emit_event stage_end stage "$CURRENT_STAGE" status "$rv" duration "$(( SECONDS - CURRENT_STAGE_STARTED ))"
+    fi
     aws_notify "RattlesnakeOS Build FAILED"
   fi
   exit $rv
 }
 
+BUILD_REASONS=()
+
+# Records one of the reasons a build is needed.  BUILD_REASON keeps the
+# upstream format, a space-separated list of single-quoted reasons.
+add_build_reason() {
+  BUILD_REASONS+=("$1")
+  BUILD_REASON="${BUILD_REASON:+$BUILD_REASON }'$1'"
+  emit_event build_reason reason "$1"
+}
+
+INTERSTAGE_FILE="$HOME/s3/interstage/env.$JENKINS_BUILD_NUMBER.json"
+
 persist_latest_versions() {
-  rm -rf env*.save
-  mkdir -p s3/interstage
-  cat > s3/interstage/env.$JENKINS_BUILD_NUMBER.save <<EOF
-STACK_UPDATE_MESSAGE="$STACK_UPDATE_MESSAGE"
-LATEST_STACK_VERSION="$LATEST_STACK_VERSION"
-LATEST_CHROMIUM="$LATEST_CHROMIUM"
-FDROID_CLIENT_VERSION="$FDROID_CLIENT_VERSION"
-FDROID_PRIV_EXT_VERSION="$FDROID_PRIV_EXT_VERSION"
-AOSP_BUILD="$AOSP_BUILD"
-BUILD_TIMESTAMP="$BUILD_TIMESTAMP"
-BUILD_REASON="$BUILD_REASON"
-AOSP_BRANCH="$AOSP_BRANCH"
-EOF
+  mkdir -p "$(dirname "$INTERSTAGE_FILE")"
+  local args=(
+    -var STACK_UPDATE_MESSAGE="$STACK_UPDATE_MESSAGE"
+    -var LATEST_STACK_VERSION="$LATEST_STACK_VERSION"
+    -var LATEST_CHROMIUM="$LATEST_CHROMIUM"
+    -var FDROID_CLIENT_VERSION="$FDROID_CLIENT_VERSION"
+    -var FDROID_PRIV_EXT_VERSION="$FDROID_PRIV_EXT_VERSION"
+    -var AOSP_BUILD="$AOSP_BUILD"
+    -var BUILD_TIMESTAMP="$BUILD_TIMESTAMP"
+    -var BUILD_REASON="$BUILD_REASON"
+    -var AOSP_BRANCH="$AOSP_BRANCH"
+    -list BUILD_REASONS
+    -list CUSTOM_REPO_COMMITS
+  )
+  local reason
+  for reason in "${BUILD_REASONS[@]}" ; do
+    args+=(-list BUILD_REASONS="$reason")
+  done
+  local commit
+  for commit in "${CUSTOM_REPO_COMMITS[@]}" ; do
+    args+=(-list CUSTOM_REPO_COMMITS="$commit")
+  done
+  "$RENDER_HELPER" interstage -file "$INTERSTAGE_FILE" save "${args[@]}"
+  emit_event versions \
+    stack "$LATEST_STACK_VERSION" \
+    aosp_build "$AOSP_BUILD" \
+    aosp_branch "$AOSP_BRANCH" \
+    chromium "$LATEST_CHROMIUM" \
+    fdroid_client "$FDROID_CLIENT_VERSION" \
+    fdroid_priv_ext "$FDROID_PRIV_EXT_VERSION"
   >&2 echo ====== This is the build environment from the standpoint of the persist ======
-  >&2 env
+  >&2 "$RENDER_HELPER" interstage env
   >&2 echo ====== End of the build environment from the standpoint of the persist =======
 }
 
 reload_latest_versions() {
-  source s3/interstage/env.$JENKINS_BUILD_NUMBER.save
+  local assignments
+  assignments=$("$RENDER_HELPER" interstage -file "$INTERSTAGE_FILE" load -require AOSP_BUILD,AOSP_BRANCH,BUILD_TIMESTAMP,LATEST_CHROMIUM) || return $?
+  eval "$assignments"
   # Must redo what check_for_new_versions does in order to get the right pinned version.
   if [ ! -z "$CHROMIUM_PINNED_VERSION" ]; then
     log "Setting LATEST_CHROMIUM to pinned version $CHROMIUM_PINNED_VERSION"
     LATEST_CHROMIUM="$CHROMIUM_PINNED_VERSION"
   fi
   >&2 echo ====== This is the build environment from the standpoint of the restore ======
-  >&2 env
+  >&2 "$RENDER_HELPER" interstage env
   >&2 echo ====== End of the build environment from the standpoint of the restore =======
 }
 
@@ -827,9 +1670,13 @@ then
 full_run() {
   log_header ${FUNCNAME}
 
-  get_latest_versions
-  persist_latest_versions
-  check_for_new_versions
+  start_artifact_list
+  run_stage get_latest_versions
+  # Persisted once before the check, in case the check finds no build
+  # is needed and exits, and once after, to record the reasons it found.
+  run_stage persist_latest_versions
+  run_stage check_for_new_versions
+  run_stage persist_latest_versions
 }
 else
 full_run() {
@@ -837,45 +1684,35 @@ full_run() {
 
   if [ "$STAGE" != "" ] ; then
     reload_latest_versions
+    compute_checkpoint_dir
     if [ "$STAGE" == "release" ] ; then
-      "$STAGE" "${DEVICE}"
+      run_stage "$STAGE" "${DEVICE}"
     elif [ "$STAGE" == "rebuild_marlin_kernel" ] ; then
       if [ "${DEVICE}" == "marlin" ] || [ "${DEVICE}" == "sailfish" ]; then
-        "$STAGE"
+        run_stage "$STAGE"
       fi
     elif [ "$STAGE" == "attestation_setup" ] ; then
       if [ "${ENABLE_ATTESTATION}" == "true" ]; then
-        attestation_setup
+        run_stage attestation_setup
       fi
+    elif is_build_stage "$STAGE" && ! stage_applies "$STAGE" ; then
+      log "Skipping stage $STAGE, which does not apply to this build"
+      emit_event stage_skip stage "$STAGE" reason not_applicable
     else
-      "$STAGE"
+      run_stage "$STAGE"
+    fi
+    if [ "$STAGE" == "checkpoint_versions" ] ; then
+      clear_stage_checkpoints
     fi
   else
-    get_latest_versions
-    check_for_new_versions
+    run_stage get_latest_versions
+    run_stage persist_latest_versions
+    run_stage check_for_new_versions
+    run_stage persist_latest_versions
     aws_notify "RattlesnakeOS Build STARTED"
-    setup_env
-    check_chromium
-    fetch_chromium
-    build_chromium
-    aosp_repo_init
-    aosp_repo_modifications
-    aosp_repo_sync
-    aws_import_keys
-    if [ "${ENABLE_ATTESTATION}" == "true" ]; then
-      attestation_setup
-    fi
-    setup_vendor
-    apply_patches
-    # only marlin and sailfish need kernel rebuilt so that verity_key is included
-    if [ "${DEVICE}" == "marlin" ] || [ "${DEVICE}" == "sailfish" ]; then
-      rebuild_marlin_kernel
-    fi
-    build_aosp
-    release "${DEVICE}"
-    aws_upload
-    checkpoint_versions
-    aws_notify "RattlesnakeOS Build SUCCESS"
+    compute_checkpoint_dir
+    start_artifact_list
+    run_build_stages
   fi
 }
 fi
@@ -883,6 +1720,10 @@ fi
 full_run
 `
 
+	// chromium_args_gn writes the upstream args.gn found above.
+	txt = strings.Replace(txt, "UPSTREAM_DEFAULT_VERSION\n", defaultVersion[1]+"\n", 1)
+	txt = strings.Replace(txt, "UPSTREAM_ARGS_GN\n", argsGN[1], 1)
+
 	return txt, nil
 }
 
@@ -891,63 +1732,371 @@ var device = flag.String("device", "marlin", "build the stack for this device")
 var releaseDownloadAddress = flag.String("release-download-address", "", "URL where the Android platform will look for published updates")
 var buildType = flag.String("build-type", "user", "build type (user or userdebug)")
 var chromiumVersion = flag.String("chromium-version", "", "build with a specific version of Chromium")
-var hostsFileUrl = flag.String("hosts-file-url", "", "build with a custom hosts file from an URL")
+var hostsFileUrl = flag.String("hosts-file-url", "", "build with a custom hosts file from an URL (same as -hosts-file with an URL)")
 var ignoreVersionChecks = flag.Bool("ignore-version-checks", false, "ignore version checks altogether, building again")
+var vendorRollbackBuilds = flag.Int("vendor-rollback-builds", 1, "number of older AOSP builds whose extracted vendor files are kept, for rollback")
+var factoryImagesDir = flag.String("factory-images-dir", "", "extract vendor files from the factory images in this directory instead of downloading them")
+var factoryImagesSHA256Sums = flag.String("factory-images-sha256sums", "", "file with the expected SHA-256 hashes of the factory images in -factory-images-dir, in sha256sum format")
+var verifyKeyring = flag.String("verify-keyring", "", "verify the signatures of fetched sources against the public keys in this file, or directory of files (such as gpgkeys/)")
+var verifyPolicy = flag.String("verify-policy", "warn", "what to do with fetched sources that do not verify: warn, or enforce (fail the build)")
+var sourceBundle = flag.String("source-bundle", "", "build without network access from this source bundle, made with the export-sources subcommand")
+var repoReference = flag.String("repo-reference", "", "path of a local AOSP mirror (made with repo init --mirror) that repo init borrows objects from")
+var browser = flag.String("browser", "chromium", "browser to put in the product: chromium, bromite (Chromium with the Bromite patches), prebuilt (the APK given with -browser-apk) or none")
+var browserAPK = flag.String("browser-apk", "", "APK of the browser to put in the product with -browser prebuilt")
+var releaseChannel = flag.String("release-channel", "stable", "release channel to publish to and the Updater to check: stable, beta, dev or canary")
+var updaterCheckInterval = flag.Duration("updater-check-interval", 0, "interval between checks of the Updater for updates, e.g. 6h (default that of the Updater)")
+var updaterNetwork = flag.String("updater-network", "", "network the Updater downloads updates over by default: any, unmetered or not-roaming (default that of the Updater)")
+var updaterAutoInstall = flag.String("updater-auto-install", "", "whether the Updater reboots into installed updates by itself when the device is idle, by default: true or false (default that of the Updater)")
+var sandboxCustomScripts = flag.Bool("sandbox-custom-scripts", true, "run custom scripts in a sandbox (made with bubblewrap) without network, and without access to anything but the AOSP tree")
+var urlRewrites listFlag
+var hostsFiles listFlag
+var hostsAllowlists listFlag
+
+func init() {
+	flag.Var(&hostsFiles, "hosts-file", "hosts file to merge into the hosts file of the product, a local path or an http(s) URL (repeatable)")
+	flag.Var(&hostsAllowlists, "hosts-allowlist", "file of host names (or *.domain patterns) to leave out of the hosts file, one per line (repeatable)")
+	flag.Var(&urlRewrites, "url-rewrite", "original=replacement: fetch git URLs starting with original from replacement instead, as with git's insteadOf (repeatable)")
+}
+
 var customConfig = flag.String("custom-config", "", "path to a JSON file that has customizations (patches, script, prebuilts, et cetera) in the same AWSStackConfig structure documented in https://github.com/dan-v/rattlesnakeos-stack/README.md -- only the Custom structure members are respected")
 
 type myStackConfig struct {
 	*stack.AWSStackConfig
 	BuildType              string
 	ReleaseDownloadAddress string
+	VendorRollbackBuilds   int
+	// FactoryImagesDir and FactoryImagesSHA256Sums are absolute paths, or
+	// empty to download factory images.
+	FactoryImagesDir        string
+	FactoryImagesSHA256Sums string
+	// SourceBundle is an absolute path, or empty to fetch sources from
+	// the network.
+	SourceBundle  string
+	RepoReference string
+	URLRewrites   []urlRewrite
+	// VerifyKeyring is an absolute path, or empty not to verify sources.
+	VerifyKeyring string
+	VerifyPolicy  string
+	// CustomRevisions are the revisions custom entries are pinned to, by
+	// their repo member, <repo>#<revision>.
+	CustomRevisions map[string]string
+	// CustomLocalDirs are the copies of local custom directories in the
+	// workspace, which custom entries name instead of repositories.
+	CustomLocalDirs map[string]localCustomDir
+	// CustomPrebuiltPins are the pins of the APKs of custom prebuilt
+	// repositories, by repository.
+	CustomPrebuiltPins map[string]*prebuiltPins
+	// CustomProduct is the product configuration, and CustomProductDir the
+	// directory the build script is rendered with it in, or empty if there
+	// is none.
+	CustomProduct    *productConfig
+	CustomProductDir string
+	// CustomChromium are the GN arguments and patches the custom
+	// configuration adds to the build of Chromium.
+	CustomChromium *chromiumConfig
+	// Browser is the browser put in the product, and BrowserAPK the
+	// absolute path of its APK if it is prebuilt.
+	Browser    string
+	BrowserAPK string
+	// HostsSources are the hosts files (absolute paths or URLs) merged
+	// into the hosts file of the product, and HostsAllowlists the files of
+	// host names left out of it.
+	HostsSources    []string
+	HostsAllowlists []string
+	// Updater is the release channel and the defaults of the Updater.
+	Updater *updaterConfig
+	// SandboxCustomScripts runs custom scripts in a sandbox instead of
+	// sourcing them.
+	SandboxCustomScripts bool
 }
 
-func renderTemplate(templateStr string, params interface{}) ([]byte, error) {
-	templ, err := template.New("template").Delims("<%", "%>").Parse(templateStr)
-	if err != nil {
-		return nil, err
+// urlRewrite makes git fetch URLs that start with Original from
+// Replacement instead.
+type urlRewrite struct {
+	Original    string
+	Replacement string
+}
+
+// GitConfigParameters is the value of GIT_CONFIG_PARAMETERS (the variable
+// git -c sets for the commands git runs) that applies the URL rewrites.
+func (c *myStackConfig) GitConfigParameters() string {
+	params := []string{}
+	for _, r := range c.URLRewrites {
+		params = append(params, shellQuote("url."+r.Replacement+".insteadOf="+r.Original))
 	}
+	return strings.Join(params, " ")
+}
 
-	buffer := new(bytes.Buffer)
+// describeRepo describes where the files of a custom entry come from: a
+// repository, and the revision it is pinned to, or a local directory, and
+// the digest of its contents.  Unpinned repositories are described as they
+// were before pinning existed, so that their descriptions do not change.
+func (c *myStackConfig) describeRepo(repo string) string {
+	if local, ok := c.CustomLocalDirs[repo]; ok {
+		return "path=" + local.Source + " contents=" + local.Digest
+	}
+	if revision, ok := c.CustomRevisions[repo]; ok {
+		return "repo=" + c.repoURL(repo) + " revision=" + revision
+	}
+	return "repo=" + repo
+}
 
-	if err = templ.Execute(buffer, params); err != nil {
-		return nil, err
+// CustomConfigDescription is what dumpcustomconfig prints in the build
+// script.  The build script records it after every successful build, and
+// a difference between it and the recorded one causes a rebuild.
+func (c *myStackConfig) CustomConfigDescription() string {
+	lines := []string{"  Custom configuration:"}
+	custom := false
+	if c.CustomManifestRemotes != nil {
+		custom = true
+		for _, r := range *c.CustomManifestRemotes {
+			lines = append(lines, fmt.Sprintf("    Remote name=%s fetch=%s revision=%s", r.Name, r.Fetch, r.Revision))
+		}
+	}
+	if c.CustomManifestProjects != nil {
+		for _, p := range *c.CustomManifestProjects {
+			custom = true
+			lines = append(lines, fmt.Sprintf("    Project path=%s name=%s remote=%s", p.Path, p.Name, p.Remote))
+		}
+	}
+	if c.CustomPatches != nil {
+		custom = true
+		for _, r := range *c.CustomPatches {
+			for _, patch := range r.Patches {
+				lines = append(lines, fmt.Sprintf("    Patch %s patch=%s", c.describeRepo(r.Repo), patch))
+			}
+		}
+	}
+	if c.CustomScripts != nil {
+		custom = true
+		for _, r := range *c.CustomScripts {
+			for _, script := range r.Scripts {
+				lines = append(lines, fmt.Sprintf("    Script %s script=%s", c.describeRepo(r.Repo), script))
+			}
+		}
+	}
+	if c.CustomPrebuilts != nil {
+		for _, r := range *c.CustomPrebuilts {
+			for _, module := range r.Modules {
+				lines = append(lines, fmt.Sprintf("    Prebuilt %s PRODUCT_PACKAGES=%s", c.describeRepo(r.Repo), module))
+			}
+		}
+	}
+	if c.CustomProduct != nil && !c.CustomProduct.empty() {
+		custom = true
+		for _, item := range c.CustomProduct.Items() {
+			if !strings.HasPrefix(item, "remove-package ") {
+				lines = append(lines, "    Product "+item)
+			}
+		}
+		for _, module := range c.CustomProduct.RemovePackages {
+			lines = append(lines, "    Remove PRODUCT_PACKAGES="+module)
+		}
+	}
+	for _, r := range c.CustomChromium.Patches {
+		custom = true
+		for _, patch := range r.Patches {
+			lines = append(lines, fmt.Sprintf("    Chromium patch %s patch=%s", c.describeRepo(r.Repo), patch))
+		}
 	}
+	for _, name := range c.CustomChromium.gnArgNames() {
+		custom = true
+		lines = append(lines, fmt.Sprintf("    Chromium GN argument %s = %s", name, c.CustomChromium.GNArgs[name]))
+	}
+	if !custom {
+		lines = append(lines, "No custom configuration.")
+	}
+	return strings.Join(lines, "\n")
+}
 
-	outputBytes, err := ioutil.ReadAll(buffer)
-	if err != nil {
-		return nil, err
+// customRevisions pins custom patch, script, prebuilt and Chromium patch
+// entries to the revisions (commits, tags or branches) of their revision
+// member, which the upstream configuration structures do not have.  The
+// repo member of a pinned entry becomes <repo>#<revision>, so that entries
+// naming the same repository may be pinned to different revisions, and the
+// build fetches each of them at its own.  It returns the revisions by the
+// new repo member.
+func customRevisions(m map[string]interface{}) (map[string]string, error) {
+	revisions := map[string]string{}
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "custompatches", "customscripts", "customprebuilts", "chromiumpatches":
+		default:
+			continue
+		}
+		entries, _ := v.([]interface{})
+		for _, e := range entries {
+			entry, _ := e.(map[string]interface{})
+			var repoField, repo, revision string
+			for field, value := range entry {
+				switch strings.ToLower(field) {
+				case "repo":
+					repoField = field
+					repo, _ = value.(string)
+				case "revision":
+					revision, _ = value.(string)
+				}
+			}
+			if revision == "" {
+				continue
+			}
+			if isLocalRepo(repo) {
+				return nil, fmt.Errorf("local custom directory %s cannot be pinned to a revision", repo)
+			}
+			pinned := repo + "#" + revision
+			entry[repoField] = pinned
+			revisions[pinned] = revision
+		}
 	}
-	return outputBytes, nil
+	return revisions, nil
 }
 
-func main() {
-	flag.Parse()
+// repoURL returns the URL of the repository of a custom entry, which is its
+// repo member less the revision it is pinned to, if any.
+func (c *myStackConfig) repoURL(repo string) string {
+	if revision, ok := c.CustomRevisions[repo]; ok {
+		return strings.TrimSuffix(repo, "#"+revision)
+	}
+	return repo
+}
+
+// loadConfig builds the stack configuration from the command line flags
+// and the custom configuration file they name.
+func loadConfig() (*myStackConfig, error) {
 	customizations := stack.AWSStackConfig{}
+	revisions := map[string]string{}
+	pins := map[string]*prebuiltPins{}
+	product := &productConfig{}
+	chromium := &chromiumConfig{}
 	if *customConfig != "" {
 		contents, err := ioutil.ReadFile(*customConfig)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		m := make(map[string]interface{})
 		err = json.Unmarshal(contents, &m)
 		if err != nil {
-			panic(err)
-		}
-		for k, v := range(m) {
-                    if strings.Contains(k, "-") {
-                        delete(m, k)
-                        k = strings.Replace(k, "-", "", -1)
-                        m[k] = v
-                    }
-                }
-                contents, err = json.MarshalIndent(m, "", "    ")
+			return nil, err
+		}
+		for k, v := range m {
+			if strings.Contains(k, "-") {
+				delete(m, k)
+				k = strings.Replace(k, "-", "", -1)
+				m[k] = v
+			}
+		}
+		if err := customPaths(m); err != nil {
+			return nil, err
+		}
+		if revisions, err = customRevisions(m); err != nil {
+			return nil, err
+		}
+		contents, err = json.MarshalIndent(m, "", "    ")
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		err = json.Unmarshal(contents, &customizations)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		if pins, err = customPrebuiltPins(m); err != nil {
+			return nil, err
+		}
+		if product, err = customProductConfig(m); err != nil {
+			return nil, err
 		}
+		if chromium, err = customChromiumConfig(m); err != nil {
+			return nil, err
+		}
+	}
+	paths := []*string{output, customConfig, factoryImagesDir, factoryImagesSHA256Sums, sourceBundle, repoReference, verifyKeyring, browserAPK}
+	for _, p := range paths {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return nil, err
+		}
+		*p = abs
+	}
+	if *factoryImagesSHA256Sums != "" && *factoryImagesDir == "" {
+		return nil, fmt.Errorf("-factory-images-sha256sums requires -factory-images-dir")
+	}
+	if *verifyPolicy != "warn" && *verifyPolicy != "enforce" {
+		return nil, fmt.Errorf("-verify-policy must be warn or enforce, not %q", *verifyPolicy)
+	}
+	if err := checkBrowser(*browser, *browserAPK); err != nil {
+		return nil, err
+	}
+	updater, err := newUpdaterConfig(*releaseChannel, *updaterCheckInterval, *updaterNetwork, *updaterAutoInstall)
+	if err != nil {
+		return nil, err
+	}
+	if updater.Channel != "stable" {
+		if product.Properties == nil {
+			product.Properties = map[string]string{}
+		}
+		product.Properties[updaterChannelProperty] = updater.Channel
+	}
+	hostsSources := []string{}
+	for _, source := range append(hostsFiles, *hostsFileUrl) {
+		if source == "" {
+			continue
+		}
+		if isHostsURL(source) && *sourceBundle != "" {
+			// The build downloads it when it checks for new versions,
+			// which an offline build cannot do.
+			return nil, fmt.Errorf("-hosts-file %s is an URL, which a build from -source-bundle cannot download; download it and pass its path instead", source)
+		}
+		if !isHostsURL(source) {
+			abs, err := filepath.Abs(source)
+			if err != nil {
+				return nil, err
+			}
+			source = abs
+		}
+		hostsSources = append(hostsSources, source)
+	}
+	allowlists := []string{}
+	for _, path := range hostsAllowlists {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		allowlists = append(allowlists, abs)
+	}
+	if len(allowlists) > 0 && len(hostsSources) == 0 {
+		return nil, fmt.Errorf("-hosts-allowlist requires -hosts-file")
+	}
+	if err := checkHostsConfig(hostsSources, allowlists); err != nil {
+		return nil, err
+	}
+	rewrites := []urlRewrite{}
+	for _, r := range urlRewrites {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("-url-rewrite %q is not in original=replacement form", r)
+		}
+		rewrites = append(rewrites, urlRewrite{parts[0], parts[1]})
+	}
+	// Local custom directories are relative to the custom configuration,
+	// and copied next to the build script, in the workspace, when it is
+	// rendered.
+	locals, err := localizeCustomRepos(&customizations, chromium.Patches, filepath.Dir(*customConfig), filepath.Join(filepath.Dir(*output), "custom-files"))
+	if err != nil {
+		return nil, err
+	}
+	for dir, local := range locals {
+		if p, ok := pins[local.Source]; ok {
+			pins[dir] = p
+			delete(pins, local.Source)
+		}
+	}
+	// The product configuration is generated next to the build script too.
+	productDir := ""
+	if product.needsMakefile() {
+		productDir = filepath.Join(filepath.Dir(*output), "custom-product")
 	}
 	ignored := "ignored"
 	preconfig := &stack.AWSStackConfig{
@@ -965,7 +2114,7 @@ func main() {
 		Device:                 *device,
 		ChromiumVersion:        *chromiumVersion,
 		IgnoreVersionChecks:    *ignoreVersionChecks,
-		HostsFile:              *hostsFileUrl,
+		HostsFile:              "",
 		EncryptedKeys:          false,
 		CustomPatches:          customizations.CustomPatches,
 		CustomScripts:          customizations.CustomScripts,
@@ -973,10 +2122,87 @@ func main() {
 		CustomManifestRemotes:  customizations.CustomManifestRemotes,
 		CustomManifestProjects: customizations.CustomManifestProjects,
 	}
-	config := &myStackConfig{
-		AWSStackConfig:         preconfig,
-		BuildType:              *buildType,
-		ReleaseDownloadAddress: *releaseDownloadAddress,
+	return &myStackConfig{
+		AWSStackConfig:          preconfig,
+		BuildType:               *buildType,
+		ReleaseDownloadAddress:  *releaseDownloadAddress,
+		VendorRollbackBuilds:    *vendorRollbackBuilds,
+		FactoryImagesDir:        *factoryImagesDir,
+		FactoryImagesSHA256Sums: *factoryImagesSHA256Sums,
+		SourceBundle:            *sourceBundle,
+		RepoReference:           *repoReference,
+		URLRewrites:             rewrites,
+		VerifyKeyring:           *verifyKeyring,
+		VerifyPolicy:            *verifyPolicy,
+		CustomRevisions:         revisions,
+		CustomLocalDirs:         locals,
+		CustomPrebuiltPins:      pins,
+		CustomProduct:           product,
+		CustomProductDir:        productDir,
+		CustomChromium:          chromium,
+		Browser:                 *browser,
+		BrowserAPK:              *browserAPK,
+		HostsSources:            hostsSources,
+		HostsAllowlists:         allowlists,
+		Updater:                 updater,
+		SandboxCustomScripts:    *sandboxCustomScripts,
+	}, nil
+}
+
+func renderTemplate(templateStr string, params interface{}) ([]byte, error) {
+	funcs := template.FuncMap{"shellquote": shellQuote}
+	templ, err := template.New("template").Delims("<%", "%>").Funcs(funcs).Parse(templateStr)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := new(bytes.Buffer)
+
+	if err = templ.Execute(buffer, params); err != nil {
+		return nil, err
+	}
+
+	outputBytes, err := ioutil.ReadAll(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return outputBytes, nil
+}
+
+// subcommands maps the name of each helper subcommand to its implementation.
+// Helper subcommands are invoked as the first argument to this program,
+// whether by CI or by the build script itself.
+var subcommands = map[string]func(args []string) error{}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	flag.Usage = func() {
+		names := []string{}
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options]\n       %s <subcommand> [options] [arguments]\n\nSubcommands: %s\n\nOptions:\n", os.Args[0], os.Args[0], strings.Join(names, ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	config, err := loadConfig()
+	if err != nil {
+		panic(err)
+	}
+	if err := copyLocalCustomDirs(config, filepath.Join(filepath.Dir(*output), "custom-files")); err != nil {
+		panic(err)
+	}
+	if err := writeProductConfig(config.CustomProduct, filepath.Join(filepath.Dir(*output), "custom-product")); err != nil {
+		panic(err)
 	}
 
 	modded, err := alterTemplate(templates.BuildTemplate)
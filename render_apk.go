@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The IDs of the signature schemes in the APK Signing Block, which sits
+// between the ZIP entries of an APK and its central directory.  See
+// https://source.android.com/security/apksigning/v2 for its format.
+const (
+	apkSignatureSchemeV2 = 0x7109871a
+	apkSignatureSchemeV3 = 0xf05368c0
+	apkSigningBlockMagic = "APK Sig Block 42"
+)
+
+var errNoAPKSigningBlock = errors.New("there is no APK Signing Block (the APK is signed with the v1 scheme only, or not at all)")
+
+// apkSignatureAlgorithm is a signature algorithm of the v2 and v3 schemes,
+// with the hash its content digest is made with.
+type apkSignatureAlgorithm struct {
+	hash   crypto.Hash
+	verify func(key interface{}, hashed []byte, signature []byte) error
+}
+
+func verifyRSAPSS(saltLength int, hash crypto.Hash) func(interface{}, []byte, []byte) error {
+	return func(key interface{}, hashed []byte, signature []byte) error {
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the key is not an RSA key")
+		}
+		return rsa.VerifyPSS(pub, hash, hashed, signature, &rsa.PSSOptions{SaltLength: saltLength})
+	}
+}
+
+func verifyRSAPKCS1(hash crypto.Hash) func(interface{}, []byte, []byte) error {
+	return func(key interface{}, hashed []byte, signature []byte) error {
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("the key is not an RSA key")
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, hashed, signature)
+	}
+}
+
+// dsaSignature is the ASN.1 form of ECDSA and DSA signatures.
+type dsaSignature struct {
+	R, S *big.Int
+}
+
+func verifyECDSA(key interface{}, hashed []byte, signature []byte) error {
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the key is not an ECDSA key")
+	}
+	var sig dsaSignature
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return err
+	}
+	if sig.R == nil || sig.S == nil || !ecdsa.Verify(pub, hashed, sig.R, sig.S) {
+		return fmt.Errorf("ECDSA verification failure")
+	}
+	return nil
+}
+
+func verifyDSA(key interface{}, hashed []byte, signature []byte) error {
+	pub, ok := key.(*dsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the key is not a DSA key")
+	}
+	var sig dsaSignature
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return err
+	}
+	if sig.R == nil || sig.S == nil || !dsa.Verify(pub, hashed, sig.R, sig.S) {
+		return fmt.Errorf("DSA verification failure")
+	}
+	return nil
+}
+
+var apkSignatureAlgorithms = map[uint32]apkSignatureAlgorithm{
+	0x0101: {crypto.SHA256, verifyRSAPSS(32, crypto.SHA256)},
+	0x0102: {crypto.SHA512, verifyRSAPSS(64, crypto.SHA512)},
+	0x0103: {crypto.SHA256, verifyRSAPKCS1(crypto.SHA256)},
+	0x0104: {crypto.SHA512, verifyRSAPKCS1(crypto.SHA512)},
+	0x0201: {crypto.SHA256, verifyECDSA},
+	0x0202: {crypto.SHA512, verifyECDSA},
+	0x0301: {crypto.SHA256, verifyDSA},
+}
+
+// lengthPrefixed splits the value prefixed by its length, as the v2 and v3
+// schemes encode every value, off the start of b.
+func lengthPrefixed(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("truncated APK Signing Block")
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(n) > uint64(len(b)-4) {
+		return nil, nil, fmt.Errorf("truncated APK Signing Block")
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+// lengthPrefixedSequence splits a length-prefixed sequence of
+// length-prefixed values.
+func lengthPrefixedSequence(b []byte) ([][]byte, []byte, error) {
+	seq, rest, err := lengthPrefixed(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	items := [][]byte{}
+	for len(seq) > 0 {
+		var item []byte
+		if item, seq, err = lengthPrefixed(seq); err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rest, nil
+}
+
+// apkLayout locates the APK Signing Block, the central directory and the
+// end of central directory record of an APK.
+type apkLayout struct {
+	blockStart int
+	cdStart    int
+	eocdStart  int
+	// pairs are the values of the signing block, by ID.
+	pairs map[uint32][]byte
+}
+
+func parseAPKLayout(data []byte) (*apkLayout, error) {
+	eocd := -1
+	for i := len(data) - 22; i >= 0 && i >= len(data)-22-0xffff; i-- {
+		if binary.LittleEndian.Uint32(data[i:]) == 0x06054b50 && int(binary.LittleEndian.Uint16(data[i+20:])) == len(data)-i-22 {
+			eocd = i
+			break
+		}
+	}
+	if eocd < 0 {
+		return nil, fmt.Errorf("not a ZIP file")
+	}
+	cdSize := int64(binary.LittleEndian.Uint32(data[eocd+12:]))
+	cdStart := int64(binary.LittleEndian.Uint32(data[eocd+16:]))
+	if cdStart+cdSize != int64(eocd) {
+		return nil, fmt.Errorf("the central directory does not end where the end of central directory record starts")
+	}
+	if cdStart < 32 || string(data[cdStart-16:cdStart]) != apkSigningBlockMagic {
+		return nil, errNoAPKSigningBlock
+	}
+	size := binary.LittleEndian.Uint64(data[cdStart-24:])
+	if size < 24 || size > uint64(cdStart-8) {
+		return nil, fmt.Errorf("malformed APK Signing Block")
+	}
+	start := cdStart - int64(size) - 8
+	if binary.LittleEndian.Uint64(data[start:]) != size {
+		return nil, fmt.Errorf("the sizes at the start and end of the APK Signing Block differ")
+	}
+	layout := &apkLayout{int(start), int(cdStart), eocd, map[uint32][]byte{}}
+	pairs := data[start+8 : cdStart-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, fmt.Errorf("truncated APK Signing Block")
+		}
+		n := binary.LittleEndian.Uint64(pairs)
+		if n < 4 || n > uint64(len(pairs)-8) {
+			return nil, fmt.Errorf("truncated APK Signing Block")
+		}
+		layout.pairs[binary.LittleEndian.Uint32(pairs[8:])] = pairs[12 : 8+n]
+		pairs = pairs[8+n:]
+	}
+	return layout, nil
+}
+
+// contentDigest is the digest of the contents of an APK that v2 and v3
+// signers sign: that of the digests of its 1 MiB chunks, less the signing
+// block, with the end of central directory record pointing at where the
+// central directory would be without the signing block.
+func (l *apkLayout) contentDigest(data []byte, hash crypto.Hash) []byte {
+	eocd := append([]byte{}, data[l.eocdStart:]...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(l.blockStart))
+	sections := [][]byte{data[:l.blockStart], data[l.cdStart:l.eocdStart], eocd}
+	digests := []byte{}
+	count := 0
+	prefix := make([]byte, 5)
+	for _, s := range sections {
+		for len(s) > 0 {
+			n := len(s)
+			if n > 1<<20 {
+				n = 1 << 20
+			}
+			h := hash.New()
+			prefix[0] = 0xa5
+			binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+			h.Write(prefix)
+			h.Write(s[:n])
+			digests = h.Sum(digests)
+			count++
+			s = s[n:]
+		}
+	}
+	h := hash.New()
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], uint32(count))
+	h.Write(prefix)
+	h.Write(digests)
+	return h.Sum(nil)
+}
+
+// apkSigner is a signer of an APK, whose signature has been verified.
+type apkSigner struct {
+	// Certificate is the SHA-256 digest of the signer's certificate, as
+	// apksigner verify --print-certs prints it, in lowercase hex.
+	Certificate string
+	Subject     string
+}
+
+// verifySigner verifies a signer of the v2 or v3 scheme, and the digests
+// of the contents of the APK it signed.
+func (l *apkLayout) verifySigner(data []byte, signer []byte, scheme int, digests map[crypto.Hash][]byte) (apkSigner, error) {
+	signedData, rest, err := lengthPrefixed(signer)
+	if err != nil {
+		return apkSigner{}, err
+	}
+	if scheme == 3 {
+		// The SDK versions the signer is for.
+		if len(rest) < 8 {
+			return apkSigner{}, fmt.Errorf("truncated APK Signing Block")
+		}
+		rest = rest[8:]
+	}
+	signatures, rest, err := lengthPrefixedSequence(rest)
+	if err != nil {
+		return apkSigner{}, err
+	}
+	publicKey, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return apkSigner{}, err
+	}
+	key, err := x509.ParsePKIXPublicKey(publicKey)
+	if err != nil {
+		return apkSigner{}, fmt.Errorf("cannot parse the public key of the signer: %v", err)
+	}
+
+	// Every signature made with an algorithm known here must be good, and
+	// there must be at least one.
+	verified := map[uint32]bool{}
+	for _, s := range signatures {
+		if len(s) < 4 {
+			return apkSigner{}, fmt.Errorf("truncated APK Signing Block")
+		}
+		id := binary.LittleEndian.Uint32(s)
+		algorithm, ok := apkSignatureAlgorithms[id]
+		if !ok {
+			continue
+		}
+		signature, _, err := lengthPrefixed(s[4:])
+		if err != nil {
+			return apkSigner{}, err
+		}
+		h := algorithm.hash.New()
+		h.Write(signedData)
+		if err := algorithm.verify(key, h.Sum(nil), signature); err != nil {
+			return apkSigner{}, fmt.Errorf("the signature with algorithm %#04x does not verify: %v", id, err)
+		}
+		verified[id] = true
+	}
+	if len(verified) == 0 {
+		return apkSigner{}, fmt.Errorf("the signer has no signature with a supported algorithm")
+	}
+
+	signedDigests, rest, err := lengthPrefixedSequence(signedData)
+	if err != nil {
+		return apkSigner{}, err
+	}
+	certificates, _, err := lengthPrefixedSequence(rest)
+	if err != nil {
+		return apkSigner{}, err
+	}
+	for _, d := range signedDigests {
+		if len(d) < 4 {
+			return apkSigner{}, fmt.Errorf("truncated APK Signing Block")
+		}
+		id := binary.LittleEndian.Uint32(d)
+		if !verified[id] {
+			continue
+		}
+		digest, _, err := lengthPrefixed(d[4:])
+		if err != nil {
+			return apkSigner{}, err
+		}
+		hash := apkSignatureAlgorithms[id].hash
+		if _, ok := digests[hash]; !ok {
+			digests[hash] = l.contentDigest(data, hash)
+		}
+		if !bytes.Equal(digest, digests[hash]) {
+			return apkSigner{}, fmt.Errorf("the contents of the APK do not match their signed digest")
+		}
+		delete(verified, id)
+	}
+	if len(verified) > 0 {
+		return apkSigner{}, fmt.Errorf("the signed data has no content digest for some of its signatures")
+	}
+
+	if len(certificates) == 0 {
+		return apkSigner{}, fmt.Errorf("the signer has no certificate")
+	}
+	certificate, err := x509.ParseCertificate(certificates[0])
+	if err != nil {
+		return apkSigner{}, fmt.Errorf("cannot parse the certificate of the signer: %v", err)
+	}
+	if !bytes.Equal(certificate.RawSubjectPublicKeyInfo, publicKey) {
+		return apkSigner{}, fmt.Errorf("the public key of the signer is not that of its certificate")
+	}
+	sum := sha256.Sum256(certificates[0])
+	return apkSigner{hex.EncodeToString(sum[:]), certificate.Subject.String()}, nil
+}
+
+// verifyAPK verifies the v3 signature of an APK, or its v2 signature if it
+// has no v3 one, and returns the signature scheme and the signers.  APKs
+// signed with the v1 (JAR) scheme only are not verified.
+func verifyAPK(data []byte) (int, []apkSigner, error) {
+	layout, err := parseAPKLayout(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	scheme := 3
+	block, ok := layout.pairs[apkSignatureSchemeV3]
+	if !ok {
+		scheme = 2
+		if block, ok = layout.pairs[apkSignatureSchemeV2]; !ok {
+			return 0, nil, fmt.Errorf("the APK Signing Block has neither a v2 nor a v3 signature")
+		}
+	}
+	signers, _, err := lengthPrefixedSequence(block)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(signers) == 0 {
+		return 0, nil, fmt.Errorf("the v%d signature has no signers", scheme)
+	}
+	result := []apkSigner{}
+	digests := map[crypto.Hash][]byte{}
+	for i, s := range signers {
+		signer, err := layout.verifySigner(data, s, scheme, digests)
+		if err != nil {
+			return 0, nil, fmt.Errorf("v%d signer #%d: %v", scheme, i+1, err)
+		}
+		result = append(result, signer)
+	}
+	return scheme, result, nil
+}
+
+// normalizeDigest turns a SHA-256 digest written in hex, with or without
+// colons between bytes, into lowercase hex.
+func normalizeDigest(digest string) (string, error) {
+	d := strings.ToLower(strings.Replace(strings.TrimSpace(digest), ":", "", -1))
+	if b, err := hex.DecodeString(d); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 digest in hex", digest)
+	}
+	return d, nil
+}
+
+// apkPin is what an APK of a custom prebuilt repository is pinned to: the
+// certificates it may be signed with, and the SHA-256 hash of the file.
+type apkPin struct {
+	Certificates []string
+	SHA256       string
+}
+
+// prebuiltPins are the pins of the APKs of a custom prebuilt repository.
+// Certificates are those every APK may be signed with, unless it has a
+// pin of its own in APKs, by path relative to the repository.
+type prebuiltPins struct {
+	Certificates []string
+	APKs         map[string]apkPin
+}
+
+// Args are the options of apk-verify that check the pins.
+func (p *prebuiltPins) Args() string {
+	args := []string{}
+	for _, c := range p.Certificates {
+		args = append(args, "-certificate", c)
+	}
+	paths := []string{}
+	for path := range p.APKs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		pin := p.APKs[path]
+		if len(pin.Certificates) > 0 {
+			args = append(args, "-apk-certificates", path+"="+strings.Join(pin.Certificates, ","))
+		}
+		if pin.SHA256 != "" {
+			args = append(args, "-apk-sha256", path+"="+pin.SHA256)
+		}
+	}
+	quoted := []string{}
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Items are the pins in the canonical form of the custom configuration.
+func (p *prebuiltPins) Items(source string) []string {
+	items := []string{}
+	for _, c := range p.Certificates {
+		items = append(items, fmt.Sprintf("apk-certificate %s %s", source, c))
+	}
+	for path, pin := range p.APKs {
+		for _, c := range pin.Certificates {
+			items = append(items, fmt.Sprintf("apk-certificate %s %s", source+"/"+path, c))
+		}
+		if pin.SHA256 != "" {
+			items = append(items, fmt.Sprintf("apk-sha256 %s %s", source+"/"+path, pin.SHA256))
+		}
+	}
+	return items
+}
+
+func digestList(value interface{}, what string) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a list of SHA-256 digests", what)
+	}
+	digests := []string{}
+	for _, v := range list {
+		s, _ := v.(string)
+		d, err := normalizeDigest(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", what, err)
+		}
+		digests = append(digests, d)
+	}
+	return digests, nil
+}
+
+// addCertificates adds the certificates not in a list to it.
+func addCertificates(list []string, certificates []string) []string {
+	for _, c := range certificates {
+		found := false
+		for _, existing := range list {
+			found = found || existing == c
+		}
+		if !found {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// customPrebuiltPins returns the pins of the APKs of custom prebuilt
+// repositories, set by the certificates and apks members of their entries,
+// which the upstream configuration structures do not have, by repository.
+func customPrebuiltPins(m map[string]interface{}) (map[string]*prebuiltPins, error) {
+	pins := map[string]*prebuiltPins{}
+	for k, v := range m {
+		if strings.ToLower(k) != "customprebuilts" {
+			continue
+		}
+		entries, _ := v.([]interface{})
+		for _, e := range entries {
+			entry, _ := e.(map[string]interface{})
+			var repo string
+			var certificates interface{}
+			var apks map[string]interface{}
+			for field, value := range entry {
+				switch strings.ToLower(field) {
+				case "repo":
+					repo, _ = value.(string)
+				case "certificates":
+					certificates = value
+				case "apks":
+					var ok bool
+					if apks, ok = value.(map[string]interface{}); !ok {
+						return nil, fmt.Errorf("the apks of custom prebuilt repository %s are not an object", repo)
+					}
+				}
+			}
+			if certificates == nil && apks == nil {
+				continue
+			}
+			p, ok := pins[repo]
+			if !ok {
+				p = &prebuiltPins{APKs: map[string]apkPin{}}
+				pins[repo] = p
+			}
+			if certificates != nil {
+				digests, err := digestList(certificates, "the certificates of custom prebuilt repository "+repo)
+				if err != nil {
+					return nil, err
+				}
+				p.Certificates = addCertificates(p.Certificates, digests)
+			}
+			for path, value := range apks {
+				what := fmt.Sprintf("APK %s of custom prebuilt repository %s", path, repo)
+				clean := filepath.ToSlash(filepath.Clean(path))
+				if filepath.IsAbs(path) || clean == ".." || strings.HasPrefix(clean, "../") {
+					return nil, fmt.Errorf("%s is not a path within the repository", what)
+				}
+				fields, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("the pin of %s is not an object", what)
+				}
+				pin := p.APKs[clean]
+				for field, value := range fields {
+					switch strings.ToLower(field) {
+					case "certificates":
+						digests, err := digestList(value, "the certificates of "+what)
+						if err != nil {
+							return nil, err
+						}
+						pin.Certificates = addCertificates(pin.Certificates, digests)
+					case "sha256":
+						s, _ := value.(string)
+						d, err := normalizeDigest(s)
+						if err != nil {
+							return nil, fmt.Errorf("the sha256 of %s: %v", what, err)
+						}
+						if pin.SHA256 != "" && pin.SHA256 != d {
+							return nil, fmt.Errorf("%s is pinned to both %s and %s", what, pin.SHA256, d)
+						}
+						pin.SHA256 = d
+					default:
+						return nil, fmt.Errorf("unknown member %s in the pin of %s", field, what)
+					}
+				}
+				if len(pin.Certificates) == 0 && pin.SHA256 == "" {
+					return nil, fmt.Errorf("the pin of %s has neither certificates nor a sha256", what)
+				}
+				p.APKs[clean] = pin
+			}
+		}
+	}
+	return pins, nil
+}
+
+// verifyPrebuiltAPKs checks every APK in a checkout of a custom prebuilt
+// repository against its pins, and returns what is wrong with them.  Every
+// APK must be pinned, and every pinned APK must be there.
+func verifyPrebuiltAPKs(dir string, pins *prebuiltPins) ([]string, error) {
+	problems := []string{}
+	seen := map[string]bool{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || !strings.EqualFold(filepath.Ext(p), ".apk") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		pin, ok := pins.APKs[rel]
+		if !ok {
+			pin = apkPin{Certificates: pins.Certificates}
+		}
+		if len(pin.Certificates) == 0 && pin.SHA256 == "" {
+			problems = append(problems, rel+" is not pinned")
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if pin.SHA256 != "" {
+			sum := sha256.Sum256(data)
+			if got := hex.EncodeToString(sum[:]); got != pin.SHA256 {
+				problems = append(problems, fmt.Sprintf("%s has SHA-256 hash %s, not %s", rel, got, pin.SHA256))
+				return nil
+			}
+		}
+		if len(pin.Certificates) == 0 {
+			fmt.Printf("ok        %s sha256=%s\n", rel, pin.SHA256)
+			return nil
+		}
+		scheme, signers, err := verifyAPK(data)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", rel, err))
+			return nil
+		}
+		for _, s := range signers {
+			allowed := false
+			for _, c := range pin.Certificates {
+				allowed = allowed || c == s.Certificate
+			}
+			if !allowed {
+				problems = append(problems, fmt.Sprintf("%s is signed by %s, certificate SHA-256 digest %s, which is not pinned", rel, s.Subject, s.Certificate))
+				return nil
+			}
+		}
+		for _, s := range signers {
+			fmt.Printf("ok        %s v%d certificate=%s (%s)\n", rel, scheme, s.Certificate, s.Subject)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for path := range pins.APKs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !seen[path] {
+			problems = append(problems, path+" is pinned, but not in the repository")
+		}
+	}
+	return problems, nil
+}
+
+// printAPKSigners prints the signers of APKs, and their hashes, which is
+// what to pin them to.
+func printAPKSigners(files []string) error {
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Printf("%s\n  sha256: %s\n", f, hex.EncodeToString(sum[:]))
+		scheme, signers, err := verifyAPK(data)
+		if err != nil {
+			fmt.Printf("  signature: %v\n", err)
+			continue
+		}
+		for _, s := range signers {
+			fmt.Printf("  v%d signer: %s\n    certificate: %s\n", scheme, s.Subject, s.Certificate)
+		}
+	}
+	return nil
+}
+
+func apkVerifyCommand(args []string) error {
+	flags := flag.NewFlagSet("apk-verify", flag.ExitOnError)
+	dir := flags.String("dir", "", "checkout of a custom prebuilt repository to verify the APKs of")
+	certificates := listFlag{}
+	flags.Var(&certificates, "certificate", "SHA-256 digest of a certificate any APK may be signed with (may be repeated)")
+	apkCertificates := keyValueFlag{}
+	flags.Var(apkCertificates, "apk-certificates", "path=digest,... the certificates an APK may be signed with instead (may be repeated)")
+	apkSHA256s := keyValueFlag{}
+	flags.Var(apkSHA256s, "apk-sha256", "path=hash of an APK (may be repeated)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s apk-verify -dir <directory> <pins...>\n       %s apk-verify <APK...>\n\nVerifies the signatures of the APKs in a custom prebuilt repository, and\nchecks that they are signed with pinned certificates, or have pinned\nhashes.  With APK files, prints their signers and hashes instead.\n\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *dir == "" {
+		if flags.NArg() == 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		return printAPKSigners(flags.Args())
+	}
+
+	pins := &prebuiltPins{APKs: map[string]apkPin{}}
+	for _, c := range certificates {
+		d, err := normalizeDigest(c)
+		if err != nil {
+			return err
+		}
+		pins.Certificates = append(pins.Certificates, d)
+	}
+	for path, list := range apkCertificates {
+		pin := pins.APKs[path]
+		for _, c := range strings.Split(list, ",") {
+			d, err := normalizeDigest(c)
+			if err != nil {
+				return err
+			}
+			pin.Certificates = append(pin.Certificates, d)
+		}
+		pins.APKs[path] = pin
+	}
+	for path, sum := range apkSHA256s {
+		d, err := normalizeDigest(sum)
+		if err != nil {
+			return err
+		}
+		pin := pins.APKs[path]
+		pin.SHA256 = d
+		pins.APKs[path] = pin
+	}
+	problems, err := verifyPrebuiltAPKs(*dir, pins)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Printf("MISMATCH  %s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the APKs in %s do not match their pins", *dir)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["apk-verify"] = apkVerifyCommand
+}
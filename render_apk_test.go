@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner is a key and a self-signed certificate to sign test APKs with.
+type testSigner struct {
+	key         *rsa.PrivateKey
+	certificate []byte
+}
+
+func newTestSigner(t *testing.T, name string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(100 * 365 * 24 * time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key, certificate}
+}
+
+// digest is the SHA-256 digest of the certificate, as pins have it.
+func (s *testSigner) digest() string {
+	sum := sha256.Sum256(s.certificate)
+	return hex.EncodeToString(sum[:])
+}
+
+func prefixed(values ...[]byte) []byte {
+	b := []byte{}
+	for _, v := range values {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func withID(id uint32, value []byte) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, id)
+	return append(b, prefixed(value)...)
+}
+
+// unsignedAPK is a ZIP file with a single entry, which is what an APK
+// signed with the v1 scheme only looks like here.
+func unsignedAPK(t *testing.T) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	f, err := w.Create("classes.dex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(strings.Repeat("dex\n", 1000)))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// signAPK signs an APK with the v2 scheme, with RSASSA-PKCS1-v1_5 and
+// SHA-256, as apksigner does.
+func signAPK(t *testing.T, apk []byte, s *testSigner) []byte {
+	t.Helper()
+	eocd := bytes.LastIndex(apk, []byte{0x50, 0x4b, 0x05, 0x06})
+	cdStart := int(binary.LittleEndian.Uint32(apk[eocd+16:]))
+
+	// The content digest, over 1 MiB chunks of the entries, the central
+	// directory and the end of central directory record.
+	digests := []byte{}
+	count := 0
+	for _, section := range [][]byte{apk[:cdStart], apk[cdStart:eocd], apk[eocd:]} {
+		for len(section) > 0 {
+			n := len(section)
+			if n > 1<<20 {
+				n = 1 << 20
+			}
+			h := sha256.New()
+			h.Write([]byte{0xa5, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+			h.Write(section[:n])
+			digests = h.Sum(digests)
+			count++
+			section = section[n:]
+		}
+	}
+	h := sha256.New()
+	h.Write([]byte{0x5a, byte(count), byte(count >> 8), byte(count >> 16), byte(count >> 24)})
+	h.Write(digests)
+
+	signedData := append(prefixed(prefixed(withID(0x0103, h.Sum(nil)))), prefixed(prefixed(s.certificate))...)
+	signedData = append(signedData, prefixed(nil)...)
+	hashed := sha256.Sum256(signedData)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := append(prefixed(signedData), prefixed(prefixed(withID(0x0103, signature)))...)
+	signer = append(signer, prefixed(publicKey)...)
+	value := prefixed(prefixed(signer))
+
+	pair := make([]byte, 12)
+	binary.LittleEndian.PutUint64(pair, uint64(len(value)+4))
+	binary.LittleEndian.PutUint32(pair[8:], apkSignatureSchemeV2)
+	pair = append(pair, value...)
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(pair)+8+16))
+	block := append(append(append(append([]byte{}, size...), pair...), size...), apkSigningBlockMagic...)
+
+	signed := append(append([]byte{}, apk[:cdStart]...), block...)
+	signed = append(signed, apk[cdStart:]...)
+	binary.LittleEndian.PutUint32(signed[len(signed)-len(apk)+eocd+16:], uint32(cdStart+len(block)))
+	return signed
+}
+
+func TestVerifyAPK(t *testing.T) {
+	s := newTestSigner(t, "Test Signer")
+	apk := signAPK(t, unsignedAPK(t), s)
+
+	scheme, signers, err := verifyAPK(apk)
+	if err != nil {
+		t.Fatalf("a correctly signed APK does not verify: %v", err)
+	}
+	if scheme != 2 || len(signers) != 1 || signers[0].Certificate != s.digest() || signers[0].Subject != "CN=Test Signer" {
+		t.Errorf("got scheme %d and signers %+v, not scheme 2 and certificate %s", scheme, signers, s.digest())
+	}
+
+	// A byte of the compressed entry, which the signature covers.
+	tampered := append([]byte{}, apk...)
+	tampered[45] ^= 0xff
+	if _, _, err := verifyAPK(tampered); err == nil || !strings.Contains(err.Error(), "do not match their signed digest") {
+		t.Errorf("an APK with a tampered payload verifies: %v", err)
+	}
+
+	if _, _, err := verifyAPK(unsignedAPK(t)); err != errNoAPKSigningBlock {
+		t.Errorf("an APK signed with the v1 scheme only gives %v, not %v", err, errNoAPKSigningBlock)
+	}
+}
+
+func TestVerifyPrebuiltAPKs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prebuilt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pinned := newTestSigner(t, "Pinned")
+	other := newTestSigner(t, "Other")
+	for name, data := range map[string][]byte{
+		"good.apk":  signAPK(t, unsignedAPK(t), pinned),
+		"wrong.apk": signAPK(t, unsignedAPK(t), other),
+		"v1.apk":    unsignedAPK(t),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := verifyPrebuiltAPKs(dir, &prebuiltPins{Certificates: []string{pinned.digest()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("got problems %q, not one for wrong.apk and one for v1.apk", problems)
+	}
+	if !strings.HasPrefix(problems[0], "v1.apk: ") || !strings.Contains(problems[0], "v1 scheme only") {
+		t.Errorf("an APK signed with the v1 scheme only gives %q", problems[0])
+	}
+	if want := "wrong.apk is signed by CN=Other, certificate SHA-256 digest " + other.digest() + ", which is not pinned"; problems[1] != want {
+		t.Errorf("an APK signed with the wrong certificate gives %q, not %q", problems[1], want)
+	}
+}
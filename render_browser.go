@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dan-v/rattlesnakeos-stack/stack"
+)
+
+// browsers are the choices of browser the build puts in the product, as the
+// chromium module: Chromium or Bromite (Chromium with the Bromite patches)
+// built from source, a prebuilt APK, or none at all.
+var browsers = []string{"chromium", "bromite", "prebuilt", "none"}
+
+func checkBrowser(browser string, apk string) error {
+	known := false
+	for _, b := range browsers {
+		if b == browser {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("-browser must be one of %s, not %q", strings.Join(browsers, ", "), browser)
+	}
+	if browser == "prebuilt" && apk == "" {
+		return fmt.Errorf("-browser prebuilt requires -browser-apk")
+	}
+	if browser != "prebuilt" && apk != "" {
+		return fmt.Errorf("-browser-apk requires -browser prebuilt")
+	}
+	if apk != "" {
+		if _, err := os.Stat(apk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildsChromium tells whether the build fetches and builds Chromium, which
+// it does for the browsers built from source, unless the custom
+// configuration removes the chromium module from the product.
+func (c *myStackConfig) BuildsChromium() bool {
+	return (c.Browser == "chromium" || c.Browser == "bromite") && !c.CustomProduct.Removes("chromium")
+}
+
+// RemovesChromium tells whether the chromium module is taken out of the
+// product because there is no browser, and the custom configuration does
+// not take it out already.
+func (c *myStackConfig) RemovesChromium() bool {
+	return c.Browser == "none" && !c.CustomProduct.Removes("chromium")
+}
+
+var gnArgName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// gnArgs are the arguments of args.gn files, in the order they were first
+// assigned in.  A later assignment of an argument replaces the earlier one,
+// as GN itself would not allow two in the same file.
+type gnArgs struct {
+	names  []string
+	values map[string]string
+}
+
+// stripGNComment removes the comment from a line of an args.gn file, unless
+// the line has a string before it, which the comment may be part of.
+func stripGNComment(line string) string {
+	if i := strings.Index(line, "#"); i >= 0 && !strings.Contains(line[:i], `"`) {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func (a *gnArgs) parse(text string, source string) error {
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := stripGNComment(lines[i])
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !gnArgName.MatchString(name) {
+			return fmt.Errorf("%s:%d: %q is not a GN argument assignment", source, i+1, line)
+		}
+		value := strings.TrimSpace(parts[1])
+		// Lists may span lines.
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") {
+			i++
+			if i == len(lines) {
+				return fmt.Errorf("%s: the value of %s does not end", source, name)
+			}
+			if rest := stripGNComment(lines[i]); rest != "" {
+				value += " " + rest
+			}
+		}
+		if value == "" {
+			return fmt.Errorf("%s:%d: %s has no value", source, i+1, name)
+		}
+		if _, ok := a.values[name]; !ok {
+			a.names = append(a.names, name)
+		}
+		a.values[name] = value
+	}
+	return nil
+}
+
+func (a *gnArgs) String() string {
+	s := ""
+	for _, name := range a.names {
+		s += name + " = " + a.values[name] + "\n"
+	}
+	return s
+}
+
+// chromiumConfig is what the custom configuration changes about the build of
+// Chromium: GN arguments added to (or replacing) those of the build, and
+// patches applied to the Chromium sources after those of Bromite.
+type chromiumConfig struct {
+	// GNArgs are GN values, by argument name.
+	GNArgs  map[string]string
+	Patches stack.CustomPatches
+}
+
+// gnValue makes a GN value out of a JSON one.  GN has no fractional numbers,
+// and no nested lists in build arguments.
+func gnValue(value interface{}, nested bool) (string, bool) {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		if v != math.Trunc(v) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		if strings.ContainsAny(v, "\n\r") {
+			return "", false
+		}
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(v) + `"`, true
+	case []interface{}:
+		if nested {
+			return "", false
+		}
+		items := []string{}
+		for _, item := range v {
+			s, ok := gnValue(item, true)
+			if !ok {
+				return "", false
+			}
+			items = append(items, s)
+		}
+		return "[ " + strings.Join(items, ", ") + " ]", true
+	}
+	return "", false
+}
+
+// customChromiumConfig reads the chromium-gn-args and chromium-patches
+// members of the custom configuration.  Entries of chromium-patches are
+// like those of custom-patches.
+func customChromiumConfig(m map[string]interface{}) (*chromiumConfig, error) {
+	c := &chromiumConfig{GNArgs: map[string]string{}, Patches: stack.CustomPatches{}}
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "chromiumgnargs":
+			args, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("chromium-gn-args is not an object")
+			}
+			for name, value := range args {
+				if !gnArgName.MatchString(name) {
+					return nil, fmt.Errorf("Chromium GN argument %q is not a valid name", name)
+				}
+				s, ok := gnValue(value, false)
+				if !ok {
+					return nil, fmt.Errorf("Chromium GN argument %s must be a boolean, a whole number, a single-line string or a list of them", name)
+				}
+				c.GNArgs[name] = s
+			}
+		case "chromiumpatches":
+			contents, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(contents, &c.Patches); err != nil {
+				return nil, fmt.Errorf("chromium-patches: %v", err)
+			}
+			for _, r := range c.Patches {
+				if r.Repo == "" || len(r.Patches) == 0 {
+					return nil, fmt.Errorf("chromium-patches entries need a repo (or path) and a list of patches")
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *chromiumConfig) gnArgNames() []string {
+	names := []string{}
+	for name := range c.GNArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ArgsGN is the args.gn text of the GN arguments.
+func (c *chromiumConfig) ArgsGN() string {
+	s := ""
+	for _, name := range c.gnArgNames() {
+		s += name + " = " + c.GNArgs[name] + "\n"
+	}
+	return s
+}
+
+// Items are the GN arguments as custom configuration items.  The patches
+// are items too, but ones whose order counts.
+func (c *chromiumConfig) Items() []string {
+	items := []string{}
+	for _, name := range c.gnArgNames() {
+		items = append(items, fmt.Sprintf("chromium-gn-arg %s %s", name, c.GNArgs[name]))
+	}
+	return items
+}
+
+// gnArgsCommand merges args.gn files, later files taking precedence.
+func gnArgsCommand(args []string) error {
+	flags := flag.NewFlagSet("gn-args", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s gn-args <file|-> [file...]\n\nMerges args.gn files into one, printed on standard output.  Arguments assigned by more than one file take the value of the last one.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	merged := &gnArgs{values: map[string]string{}}
+	for _, path := range flags.Args() {
+		var text []byte
+		var err error
+		if path == "-" {
+			text, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			text, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return err
+		}
+		if err := merged.parse(string(text), path); err != nil {
+			return err
+		}
+	}
+	fmt.Print(merged)
+	return nil
+}
+
+// patchIdentity identifies a series of patches by their contents and order,
+// but not by their names, so that the copies of the patches applied to a
+// tree have the same identity as the patches themselves.  A series of no
+// patches has an empty identity.
+func patchIdentity(paths []string) (string, error) {
+	if len(paths) == 0 {
+		return "", nil
+	}
+	h := sha256.New()
+	for _, p := range paths {
+		sum, _, err := hashFile(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func patchIdentityCommand(args []string) error {
+	flags := flag.NewFlagSet("patch-identity", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s patch-identity [patch...]\n\nPrints the identity of a series of patches, which changes with the contents and the order of the patches.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	id, err := patchIdentity(flags.Args())
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Println(id)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["gn-args"] = gnArgsCommand
+	subcommands["patch-identity"] = patchIdentityCommand
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chromiumCacheEntry describes a built Chromium APK kept in the cache.  The
+// entry lives in a directory named after its key, which is a hash of
+// everything that goes into the build, so that a change in any of them
+// (a new revision, different GN arguments, other source patches, another
+// toolchain) is a miss.
+type chromiumCacheEntry struct {
+	Key       string `json:"key"`
+	Revision  string `json:"revision"`
+	Args      string `json:"args"`
+	Toolchain string `json:"toolchain"`
+	// Patches is the identity of the patches applied to the source tree,
+	// if any.
+	Patches  string    `json:"patches,omitempty"`
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+const chromiumCacheEntryFile = "entry.json"
+
+// normalizeGNArgs makes args.gn files that only differ in comments, blank
+// lines, spacing or the order of their arguments compare equal.
+func normalizeGNArgs(text string) string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 && !strings.Contains(line[:i], `"`) {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			line = strings.TrimSpace(parts[0]) + " = " + strings.TrimSpace(parts[1])
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func chromiumCacheKey(revision string, args string, toolchain string, patches string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "revision %q\nargs %q\ntoolchain %q\n", revision, normalizeGNArgs(args), toolchain)
+	// Builds without patches keep the keys they had before patches were
+	// part of them.
+	if patches != "" {
+		fmt.Fprintf(h, "patches %q\n", patches)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadChromiumCacheEntry(dir string, key string) (*chromiumCacheEntry, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, key, chromiumCacheEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	e := &chromiumCacheEntry{}
+	if err := json.Unmarshal(contents, e); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return e, nil
+}
+
+func (e *chromiumCacheEntry) save(dir string) error {
+	contents, err := json.MarshalIndent(e, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(dir, e.Key, chromiumCacheEntryFile), append(contents, '\n'), 0644)
+}
+
+// chromiumCacheEntries returns the entries in the cache, most recently used
+// first.  Directories without a readable entry (such as those left behind
+// by an interrupted put) are returned as entries with only a key.
+func chromiumCacheEntries(dir string) ([]*chromiumCacheEntry, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*chromiumCacheEntry{}
+	for _, info := range infos {
+		if !info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		e, err := loadChromiumCacheEntry(dir, info.Name())
+		if err != nil {
+			e = &chromiumCacheEntry{Key: info.Name()}
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// gcChromiumCache removes all but the keep most recently used entries, and
+// any incomplete ones.
+func gcChromiumCache(dir string, keep int, w io.Writer) error {
+	entries, err := chromiumCacheEntries(dir)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, e := range entries {
+		if e.File != "" && kept < keep {
+			kept++
+			continue
+		}
+		fmt.Fprintf(w, "Evicting Chromium %s (%s) from the cache\n", e.Revision, e.Key)
+		if err := os.RemoveAll(filepath.Join(dir, e.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// keyFlags adds the options that make up a cache key to a flag set.
+func keyFlags(flags *flag.FlagSet) func() (string, *chromiumCacheEntry, error) {
+	revision := flags.String("revision", "", "Chromium revision")
+	argsFile := flags.String("args", "", "path to the args.gn the build uses")
+	toolchain := flags.String("toolchain", "", "identity of the toolchain the build uses")
+	patches := flags.String("patches", "", "identity of the patches the build applies to the source tree (see patch-identity)")
+	return func() (string, *chromiumCacheEntry, error) {
+		if *revision == "" || *argsFile == "" {
+			return "", nil, fmt.Errorf("the -revision and -args options are mandatory")
+		}
+		args, err := ioutil.ReadFile(*argsFile)
+		if err != nil {
+			return "", nil, err
+		}
+		key := chromiumCacheKey(*revision, string(args), *toolchain, *patches)
+		return key, &chromiumCacheEntry{Key: key, Revision: *revision, Args: normalizeGNArgs(string(args)), Toolchain: *toolchain, Patches: *patches}, nil
+	}
+}
+
+func cacheKey(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache key", flag.ExitOnError)
+	key := keyFlags(flags)
+	flags.Parse(args)
+	k, _, err := key()
+	if err != nil {
+		return err
+	}
+	fmt.Println(k)
+	return nil
+}
+
+// cacheGet copies the cached APK to the output path.  A miss is an error,
+// so that the build script can test for it.
+func cacheGet(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache get", flag.ExitOnError)
+	key := keyFlags(flags)
+	output := flags.String("output", "", "path to copy the cached APK to")
+	flags.Parse(args)
+	k, _, err := key()
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return fmt.Errorf("the -output option is mandatory")
+	}
+	e, err := loadChromiumCacheEntry(dir, k)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Chromium cache miss for %s", k)
+	}
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(dir, k, e.File)
+	sum, _, err := hashFile(src)
+	if err != nil {
+		return err
+	}
+	if sum != e.SHA256 {
+		os.RemoveAll(filepath.Join(dir, k))
+		return fmt.Errorf("Chromium cache entry %s is corrupt (sha256 %s, expected %s), evicted it", k, sum, e.SHA256)
+	}
+	if err := copyFile(src, *output); err != nil {
+		return err
+	}
+	e.LastUsed = time.Now().UTC()
+	return e.save(dir)
+}
+
+// cacheHas exits with status 1 if the cache has no entry for the key.
+func cacheHas(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache has", flag.ExitOnError)
+	key := keyFlags(flags)
+	flags.Parse(args)
+	k, _, err := key()
+	if err != nil {
+		return err
+	}
+	e, err := loadChromiumCacheEntry(dir, k)
+	if os.IsNotExist(err) || (err == nil && e.File == "") {
+		os.Exit(1)
+	}
+	return err
+}
+
+func cachePut(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache put", flag.ExitOnError)
+	key := keyFlags(flags)
+	keep := flags.Int("keep", 3, "number of entries to keep in the cache")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("cache put takes exactly one APK")
+	}
+	_, e, err := key()
+	if err != nil {
+		return err
+	}
+	apk := flags.Arg(0)
+	e.File = filepath.Base(apk)
+	e.SHA256, e.Size, err = hashFile(apk)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(apk, filepath.Join(dir, e.Key, e.File)); err != nil {
+		return err
+	}
+	e.Created = time.Now().UTC()
+	e.LastUsed = e.Created
+	if err := e.save(dir); err != nil {
+		return err
+	}
+	return gcChromiumCache(dir, *keep, os.Stderr)
+}
+
+func cacheLs(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache ls", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "also show the GN arguments, toolchain and patches of every entry")
+	flags.Parse(args)
+	entries, err := chromiumCacheEntries(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.File == "" {
+			fmt.Printf("%s  (incomplete)\n", e.Key)
+			continue
+		}
+		fmt.Printf("%s  Chromium %s  %d bytes  last used %s\n", e.Key, e.Revision, e.Size, e.LastUsed.Local().Format(time.RFC1123))
+		if *verbose {
+			fmt.Printf("    toolchain: %s\n    args: %s\n", e.Toolchain, strings.Replace(e.Args, "\n", "\n          ", -1))
+			if e.Patches != "" {
+				fmt.Printf("    patches: %s\n", e.Patches)
+			}
+		}
+	}
+	return nil
+}
+
+func cacheGc(dir string, args []string) error {
+	flags := flag.NewFlagSet("cache gc", flag.ExitOnError)
+	keep := flags.Int("keep", 3, "number of entries to keep in the cache")
+	flags.Parse(args)
+	return gcChromiumCache(dir, *keep, os.Stdout)
+}
+
+func cacheCommand(args []string) error {
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	dir := flags.String("dir", "chromium-cache", "path to the Chromium cache")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s cache [-dir chromium-cache] <key|has|get|put|ls|gc> [options]\n\nManages the cache of built Chromium APKs.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "key":
+		return cacheKey(*dir, rest)
+	case "get":
+		return cacheGet(*dir, rest)
+	case "has":
+		return cacheHas(*dir, rest)
+	case "put":
+		return cachePut(*dir, rest)
+	case "ls":
+		return cacheLs(*dir, rest)
+	case "gc":
+		return cacheGc(*dir, rest)
+	}
+	return fmt.Errorf("unknown cache subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["cache"] = cacheCommand
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dan-v/rattlesnakeos-stack/stack"
+)
+
+// localCustomDir is a directory of custom patches, scripts or prebuilts
+// that the custom configuration names by its path, rather than by the URL
+// of a git repository.  Rendering the build script copies it into the
+// workspace, where the build script takes it from instead of cloning a
+// repository.
+type localCustomDir struct {
+	// Source is the path of the directory in the custom configuration,
+	// and src its absolute path.
+	Source string
+	src    string
+	// Digest is a hash of the names and contents of the files in it, so
+	// that a change to any of them is a change to the custom configuration.
+	Digest string
+	// Files are the SHA-256 hashes of the files in it (or the targets of
+	// symbolic links, after "-> "), by path relative to it.
+	Files map[string]string
+}
+
+// isLocalRepo tells local paths apart from the URLs git clones from,
+// including scp-like ones such as git@github.com:user/repo.
+func isLocalRepo(repo string) bool {
+	if strings.Contains(repo, "://") {
+		return false
+	}
+	if i := strings.Index(repo, ":"); i >= 0 && !strings.Contains(repo[:i], "/") {
+		return false
+	}
+	return repo != ""
+}
+
+// copyLocalCustomDir replaces dst with a copy of the files in src, less
+// its .git directory, and returns their hashes and digest.  With an empty
+// dst, it only hashes them.
+func copyLocalCustomDir(src string, dst string) (map[string]string, string, error) {
+	if dst != "" {
+		if err := os.RemoveAll(dst); err != nil {
+			return nil, "", err
+		}
+	}
+	digest := sha256.New()
+	files := map[string]string{}
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case info.IsDir() && dst == "":
+			return nil
+		case info.IsDir():
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(digest, "%s -> %s\n", rel, target)
+			files[rel] = "-> " + target
+			if dst == "" {
+				return nil
+			}
+			return os.Symlink(target, filepath.Join(dst, rel))
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		sum, _, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(digest, "%s %s\n", rel, sum)
+		files[rel] = sum
+		if dst == "" {
+			return nil
+		}
+		if err := copyFile(p, filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+		return os.Chmod(filepath.Join(dst, rel), info.Mode().Perm())
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(files) == 0 {
+		return nil, "", fmt.Errorf("there are no files in local custom directory %s", src)
+	}
+	return files, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// localizeCustomRepos points the local directories named by custom patch,
+// script, prebuilt and Chromium patch entries (relative to base, the
+// directory of the custom configuration file) at their copies in dir, and
+// returns the copies, by their path.  It only hashes the directories;
+// copyLocalCustomDirs makes the copies.
+func localizeCustomRepos(c *stack.AWSStackConfig, chromiumPatches stack.CustomPatches, base string, dir string) (map[string]localCustomDir, error) {
+	locals := map[string]localCustomDir{}
+	localize := func(repo *string) error {
+		if !isLocalRepo(*repo) {
+			return nil
+		}
+		src := *repo
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(base, src)
+		}
+		sum := sha256.Sum256([]byte(src))
+		dst := filepath.Join(dir, filepath.Base(src)+"-"+hex.EncodeToString(sum[:4]))
+		if _, ok := locals[dst]; !ok {
+			files, digest, err := copyLocalCustomDir(src, "")
+			if err != nil {
+				return err
+			}
+			locals[dst] = localCustomDir{*repo, src, digest, files}
+		}
+		*repo = dst
+		return nil
+	}
+	if c.CustomPatches != nil {
+		for i := range *c.CustomPatches {
+			if err := localize(&(*c.CustomPatches)[i].Repo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.CustomScripts != nil {
+		for i := range *c.CustomScripts {
+			if err := localize(&(*c.CustomScripts)[i].Repo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.CustomPrebuilts != nil {
+		for i := range *c.CustomPrebuilts {
+			if err := localize(&(*c.CustomPrebuilts)[i].Repo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := range chromiumPatches {
+		if err := localize(&chromiumPatches[i].Repo); err != nil {
+			return nil, err
+		}
+	}
+	return locals, nil
+}
+
+// copyLocalCustomDirs copies the local custom directories of the
+// configuration to dir, where the build script takes them from, and removes
+// copies made for earlier configurations from it.  Only rendering the build
+// script does this, so that other subcommands leave alone the copies a
+// build may be using.
+func copyLocalCustomDirs(config *myStackConfig, dir string) error {
+	for dst, local := range config.CustomLocalDirs {
+		_, digest, err := copyLocalCustomDir(local.src, dst)
+		if err != nil {
+			return err
+		}
+		if digest != local.Digest {
+			return fmt.Errorf("local custom directory %s changed while the build script was rendered", local.Source)
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		if _, ok := config.CustomLocalDirs[filepath.Join(dir, info.Name())]; !ok {
+			if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// customPaths makes the path member of custom patch, script, prebuilt and
+// Chromium patch entries, which the upstream configuration structures do
+// not have, into their repo member, which may be a local path as well.
+func customPaths(m map[string]interface{}) error {
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "custompatches", "customscripts", "customprebuilts", "chromiumpatches":
+		default:
+			continue
+		}
+		entries, _ := v.([]interface{})
+		for _, e := range entries {
+			entry, _ := e.(map[string]interface{})
+			var repo, path string
+			for field, value := range entry {
+				switch strings.ToLower(field) {
+				case "repo":
+					repo, _ = value.(string)
+				case "path":
+					path, _ = value.(string)
+					delete(entry, field)
+				}
+			}
+			if path == "" {
+				continue
+			}
+			if repo != "" {
+				return fmt.Errorf("custom entry has both repo %s and path %s", repo, path)
+			}
+			if !isLocalRepo(path) {
+				return fmt.Errorf("custom entry path %s is not a local path", path)
+			}
+			entry["repo"] = path
+		}
+	}
+	return nil
+}
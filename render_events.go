@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildEvent is one line of the event stream that the build script writes to
+// $BUILD_EVENTS (or to the descriptor in $BUILD_EVENTS_FD).  Every event has
+// a time and a type; the rest of its members depend on the type.
+type buildEvent map[string]string
+
+func (e buildEvent) fields() []string {
+	keys := []string{}
+	for k := range e {
+		if k != "time" && k != "type" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e buildEvent) duration() string {
+	secs, err := strconv.Atoi(e["duration"])
+	if err != nil {
+		return e["duration"]
+	}
+	return (time.Duration(secs) * time.Second).String()
+}
+
+// String renders the event as a single human-readable line.
+func (e buildEvent) String() string {
+	var text string
+	switch e["type"] {
+	case "stage_start":
+		text = fmt.Sprintf("stage %s started", e["stage"])
+	case "stage_end":
+		if e["status"] == "0" {
+			text = fmt.Sprintf("stage %s succeeded in %s", e["stage"], e.duration())
+		} else {
+			text = fmt.Sprintf("stage %s FAILED with status %s after %s", e["stage"], e["status"], e.duration())
+		}
+	case "stage_skip":
+		if e["reason"] == "not_applicable" {
+			text = fmt.Sprintf("stage %s skipped (does not apply to this build)", e["stage"])
+		} else {
+			text = fmt.Sprintf("stage %s skipped (already completed)", e["stage"])
+		}
+	case "notify":
+		text = e["message"]
+	case "build_check":
+		if e["needed"] == "true" {
+			text = fmt.Sprintf("build required: %s", e["reason"])
+		} else {
+			text = fmt.Sprintf("build not required, proceeding because %s", e["forced"])
+		}
+	case "artifact":
+		text = fmt.Sprintf("artifact %s", e["path"])
+	case "custom_config":
+		text = e["text"]
+	default:
+		parts := []string{e["type"] + ":"}
+		for _, k := range e.fields() {
+			parts = append(parts, fmt.Sprintf("%s=%s", k, e[k]))
+		}
+		text = strings.Join(parts, " ")
+	}
+	return fmt.Sprintf("%s %s", e["time"], text)
+}
+
+func readEvents(r io.Reader, types map[string]bool) ([]buildEvent, error) {
+	events := []buildEvent{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		e := buildEvent{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if len(types) == 0 || types[e["type"]] {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+func writeEvents(w io.Writer, events []buildEvent, format string) error {
+	switch format {
+	case "text":
+		for _, e := range events {
+			if _, err := fmt.Fprintln(w, e); err != nil {
+				return err
+			}
+		}
+	case "html":
+		if len(events) == 0 {
+			return nil
+		}
+		fmt.Fprintln(w, "<ul>")
+		for _, e := range events {
+			text := html.EscapeString(e.String())
+			if strings.Contains(text, "\n") {
+				text = "<pre>" + text + "</pre>"
+			}
+			fmt.Fprintf(w, "<li>%s</li>\n", text)
+		}
+		_, err := fmt.Fprintln(w, "</ul>")
+		return err
+	case "json":
+		out, err := json.MarshalIndent(events, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	default:
+		return fmt.Errorf("unknown format %q (must be text, html or json)", format)
+	}
+	return nil
+}
+
+func eventsCommand(args []string) error {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	format := flags.String("format", "text", "output format (text, html or json)")
+	typeList := flags.String("type", "", "comma-separated list of event types to show (default all)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s events [options] [event file...]\n\nRenders the build script event stream (read from standard input if no files are given).\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	types := map[string]bool{}
+	for _, t := range strings.Split(*typeList, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+
+	events := []buildEvent{}
+	if flags.NArg() == 0 {
+		evs, err := readEvents(os.Stdin, types)
+		if err != nil {
+			return err
+		}
+		events = evs
+	}
+	for _, fn := range flags.Args() {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		evs, err := readEvents(f, types)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+		events = append(events, evs...)
+	}
+	return writeEvents(os.Stdout, events, *format)
+}
+
+func init() {
+	subcommands["events"] = eventsCommand
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The Jenkinsfile decides whether to build Chromium from the text of the
+// events of check_chromium, filtered as it filters them.
+func TestChromiumCheckEvents(t *testing.T) {
+	for _, c := range []struct {
+		events, want string
+	}{
+		{
+			`{"time":"t","type":"stage_start","stage":"check_chromium"}
+{"time":"t","type":"chromium","action":"reuse","revision":"80.0.3987.132"}`,
+			"chromium: action=reuse ",
+		},
+		{
+			`{"time":"t","type":"stage_skip","stage":"check_chromium","reason":"not_applicable"}`,
+			"stage check_chromium skipped (does not apply to this build)",
+		},
+		{
+			`{"time":"t","type":"stage_skip","stage":"check_chromium","reason":"completed"}`,
+			"stage check_chromium skipped (already completed)",
+		},
+	} {
+		events, err := readEvents(strings.NewReader(c.events), map[string]bool{"chromium": true, "stage_skip": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := writeEvents(&out, events, "text"); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), c.want) {
+			t.Errorf("the events\n%s\nshow as\n%s\nwithout %q", c.events, out.String(), c.want)
+		}
+	}
+}
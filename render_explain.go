@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readStateFile returns the contents of a file the build script saved with
+// `echo ... | aws s3 cp - ...`, without the trailing newline.  It returns
+// false if the file does not exist.
+func readStateFile(path string) (string, bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(contents), "\n"), true, nil
+}
+
+type stateCheck struct {
+	name     string
+	key      string
+	expected string
+}
+
+func explain(w io.Writer, config *myStackConfig, workspace string) error {
+	bucket := filepath.Join(workspace, "s3", config.Name+"-release")
+	checks := []stateCheck{
+		{"Target device", "inputs.device", config.Device},
+		{"Build type", "inputs.build_type", config.BuildType},
+		{"Stack version", "inputs.stack_version", config.Version},
+	}
+
+	statePath := filepath.Join(bucket, "build-state.json")
+	state, err := loadBuildState(statePath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(statePath); os.IsNotExist(err) {
+		// Not yet migrated by the build script; look at the old files.
+		legacy, err := legacyBuildState(bucket)
+		if err != nil {
+			return err
+		}
+		if legacy != nil {
+			state = legacy
+		}
+	}
+
+	fmt.Fprintf(w, "Build state in %s:\n", statePath)
+	if b := state.latest(); b != nil {
+		fmt.Fprintf(w, "  Last successful build: %s\n", b.Timestamp.Local().Format(time.RFC1123))
+	}
+	reasons := []string{}
+	for _, c := range checks {
+		existing, ok := state.get(c.key)
+		switch {
+		case !ok:
+			fmt.Fprintf(w, "  %s: no successful build recorded\n", c.name)
+			reasons = append(reasons, fmt.Sprintf("%s: no successful build recorded", c.name))
+		case existing != c.expected:
+			fmt.Fprintf(w, "  %s: changed from %s to %s\n", c.name, existing, c.expected)
+			reasons = append(reasons, fmt.Sprintf("%s changed from last build", c.name))
+		default:
+			fmt.Fprintf(w, "  %s: unchanged (%s)\n", c.name, existing)
+		}
+	}
+	// The commits of custom repositories are left out, as only the version
+	// check resolves them.  Builds recorded before custom configurations
+	// were fingerprinted are compared by description.
+	if existing, ok := state.get("inputs.custom_config_items"); ok {
+		recorded := []string{}
+		for _, line := range customConfigLines(existing) {
+			if !strings.HasPrefix(line, "commit ") {
+				recorded = append(recorded, line)
+			}
+		}
+		if changes := diffCustomConfig(strings.Join(recorded, "\n"), config.CustomConfigItems()); len(changes) > 0 {
+			fmt.Fprintf(w, "  Custom configuration: changed\n")
+			for _, c := range changes {
+				fmt.Fprintf(w, "    - %s\n", c)
+			}
+			reasons = append(reasons, "Custom configuration changed from last build")
+		} else {
+			fmt.Fprintf(w, "  Custom configuration: unchanged\n")
+		}
+	} else if existing, ok := state.get("inputs.custom_config"); !ok {
+		fmt.Fprintf(w, "  Custom configuration: no successful build recorded\n")
+		reasons = append(reasons, "Custom configuration: no successful build recorded")
+	} else if existing != config.CustomConfigDescription() {
+		fmt.Fprintf(w, "  Custom configuration: changed (see dumpcustomconfig)\n")
+		reasons = append(reasons, "Custom configuration changed from last build")
+	} else {
+		fmt.Fprintf(w, "  Custom configuration: unchanged\n")
+	}
+
+	saved, from, err := latestInterstage(filepath.Join(workspace, "s3", "interstage"))
+	if err != nil {
+		return err
+	}
+	if saved == nil {
+		fmt.Fprintf(w, "No version check has been recorded yet; upstream versions (AOSP, Chromium, F-Droid) were not compared.\n")
+	} else {
+		fmt.Fprintf(w, "Reasons found by the last version check (%s):\n", from)
+		recorded := saved.Lists["BUILD_REASONS"]
+		if len(recorded) == 0 {
+			fmt.Fprintf(w, "  none\n")
+		}
+		for _, r := range recorded {
+			fmt.Fprintf(w, "  - %s\n", r)
+			reasons = append(reasons, r)
+		}
+	}
+
+	switch {
+	case len(reasons) > 0:
+		fmt.Fprintf(w, "The next build will run, because:\n")
+		seen := map[string]bool{}
+		for _, r := range reasons {
+			if !seen[r] {
+				fmt.Fprintf(w, "  - %s\n", r)
+				seen[r] = true
+			}
+		}
+	case config.IgnoreVersionChecks:
+		fmt.Fprintf(w, "No build is required, but the next build will run, because version checks are ignored.\n")
+	default:
+		fmt.Fprintf(w, "The next build will not run, as all components are up to date.\n")
+	}
+	return nil
+}
+
+func explainCommand(args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	workspace := flags.String("workspace", ".", "directory the build script runs in (the one containing s3/)")
+	// The build configuration is described with the same options used to
+	// render the build script.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if f.Name != "output" {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s explain [options]\n\nExplains why the next build will or will not run.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	// The configuration is loaded as if the build script were rendered
+	// elsewhere, so that nothing in the workspace is touched.
+	tmp, err := ioutil.TempDir("", "explain.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	*output = filepath.Join(tmp, filepath.Base(*output))
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return explain(os.Stdout, config, *workspace)
+}
+
+func init() {
+	subcommands["explain"] = explainCommand
+}
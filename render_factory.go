@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// readSHA256Sums reads a file in the format sha256sum writes, and returns
+// the expected hashes by file name.
+func readSHA256Sums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != 64 {
+			return nil, fmt.Errorf("%s:%d: not a sha256sum line", path, n)
+		}
+		// sha256sum marks files hashed in binary mode with an asterisk.
+		sums[filepath.Base(strings.TrimPrefix(fields[1], "*"))] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+// findFactoryImage returns the factory image for a device and AOSP build in
+// a directory of images named the way Google names them, such as
+// taimen-pq1a.190105.004-factory-a0e5bc2c.zip.
+func findFactoryImage(dir string, device string, build string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.ToLower(device + "-" + build + "-factory-")
+	matches := []string{}
+	others := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(name), prefix) {
+			matches = append(matches, name)
+		} else if strings.HasPrefix(name, device+"-") {
+			others = append(others, name)
+		}
+	}
+	switch len(matches) {
+	case 1:
+		return filepath.Join(dir, matches[0]), nil
+	case 0:
+		sort.Strings(others)
+		msg := fmt.Sprintf("there is no factory image for %s build %s in %s", device, build, dir)
+		if len(others) > 0 {
+			msg += fmt.Sprintf(" (there are only %s)", strings.Join(others, ", "))
+		}
+		return "", fmt.Errorf("%s", msg)
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("there are several factory images for %s build %s in %s: %s", device, build, dir, strings.Join(matches, ", "))
+}
+
+// factoryImageCommand prints the path of the factory image for a device
+// and AOSP build, after checking it against its expected hash.
+func factoryImageCommand(args []string) error {
+	flags := flag.NewFlagSet("factory-image", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of factory images")
+	sha256sums := flags.String("sha256sums", "", "file with the expected SHA-256 hashes of the factory images, in sha256sum format (optional)")
+	device := flags.String("device", "", "device the factory image is for")
+	build := flags.String("build", "", "AOSP build of the factory image")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s factory-image -dir <directory> -device <device> -build <build> [options]\n\nFinds (and verifies) a locally supplied factory image.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *dir == "" || *device == "" || *build == "" {
+		return fmt.Errorf("the -dir, -device and -build options are mandatory")
+	}
+
+	image, err := findFactoryImage(*dir, *device, *build)
+	if err != nil {
+		return err
+	}
+	if *sha256sums != "" {
+		sums, err := readSHA256Sums(*sha256sums)
+		if err != nil {
+			return err
+		}
+		expected, ok := sums[filepath.Base(image)]
+		if !ok {
+			return fmt.Errorf("%s lists no SHA-256 hash for %s", *sha256sums, filepath.Base(image))
+		}
+		actual, _, err := hashFile(image)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return fmt.Errorf("factory image %s has SHA-256 hash %s, but %s expects %s", image, actual, *sha256sums, expected)
+		}
+	}
+	fmt.Println(image)
+	return nil
+}
+
+func init() {
+	subcommands["factory-image"] = factoryImageCommand
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CustomConfigItems is the custom configuration in canonical form, one item
+// per line, which the build script fingerprints to tell whether it changed
+// since the last build.  Unlike CustomConfigDescription, it covers what the
+// configuration is made of (the contents of local custom files, the
+// revisions repositories are pinned to, the pins of prebuilt APKs, the
+// product configuration and the customizations of Chromium) rather than
+// how it is worded.  The build script adds the commits custom repositories
+// resolve to, as "commit <repository> <commit>" items, and the hash of the
+// merged hosts file, as a "hosts-file /system/etc/hosts <sha256>" item.
+func (c *myStackConfig) CustomConfigItems() string {
+	lines := []string{}
+	source := func(repo string) string {
+		if local, ok := c.CustomLocalDirs[repo]; ok {
+			return "path:" + filepath.ToSlash(filepath.Clean(local.Source))
+		}
+		return repo
+	}
+	if c.CustomManifestRemotes != nil {
+		for _, r := range *c.CustomManifestRemotes {
+			lines = append(lines, fmt.Sprintf("remote %s fetch=%s revision=%s", r.Name, r.Fetch, r.Revision))
+		}
+	}
+	if c.CustomManifestProjects != nil {
+		for _, p := range *c.CustomManifestProjects {
+			lines = append(lines, fmt.Sprintf("project %s name=%s remote=%s", p.Path, p.Name, p.Remote))
+		}
+	}
+	if c.CustomPatches != nil {
+		for _, r := range *c.CustomPatches {
+			for _, patch := range r.Patches {
+				lines = append(lines, fmt.Sprintf("patch %s %s", source(r.Repo), patch))
+			}
+		}
+	}
+	if c.CustomScripts != nil {
+		for _, r := range *c.CustomScripts {
+			for _, script := range r.Scripts {
+				lines = append(lines, fmt.Sprintf("script %s %s", source(r.Repo), script))
+			}
+		}
+	}
+	if c.CustomPrebuilts != nil {
+		for _, r := range *c.CustomPrebuilts {
+			for _, module := range r.Modules {
+				lines = append(lines, fmt.Sprintf("prebuilt %s %s", source(r.Repo), module))
+			}
+		}
+	}
+	for _, r := range c.CustomChromium.Patches {
+		for _, patch := range r.Patches {
+			lines = append(lines, fmt.Sprintf("chromium-patch %s %s", source(r.Repo), patch))
+		}
+	}
+	sorted := []string{}
+	for repo, revision := range c.CustomRevisions {
+		sorted = append(sorted, fmt.Sprintf("revision %s %s", c.repoURL(repo), revision))
+	}
+	if c.CustomProduct != nil {
+		sorted = append(sorted, c.CustomProduct.Items()...)
+	}
+	sorted = append(sorted, c.CustomChromium.Items()...)
+	for repo, pins := range c.CustomPrebuiltPins {
+		sorted = append(sorted, pins.Items(source(repo))...)
+	}
+	for _, local := range c.CustomLocalDirs {
+		for path, sum := range local.Files {
+			sorted = append(sorted, fmt.Sprintf("file %s %s", filepath.ToSlash(filepath.Join(local.Source, path)), sum))
+		}
+	}
+	sort.Strings(sorted)
+	return strings.Join(append(lines, sorted...), "\n")
+}
+
+// customConfigLines returns the items of a custom configuration, without
+// blank lines or surrounding whitespace.
+func customConfigLines(items string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(items, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func customConfigFingerprint(items string) string {
+	sum := sha256.Sum256([]byte(strings.Join(customConfigLines(items), "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// keyedCustomConfigItems are the kinds of items named by their second
+// field, whose other fields are their value, so that a change of value is
+// told as such rather than as one item removed and another one added.
+var keyedCustomConfigItems = map[string]bool{
+	"remote":          true,
+	"project":         true,
+	"revision":        true,
+	"file":            true,
+	"commit":          true,
+	"build-property":  true,
+	"setting":         true,
+	"overlay":         true,
+	"chromium-gn-arg": true,
+	"hosts-file":      true,
+}
+
+func splitCustomConfigItem(line string) (key string, value string) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) == 3 && keyedCustomConfigItems[fields[0]] {
+		return fields[0] + " " + fields[1], fields[2]
+	}
+	return line, ""
+}
+
+// diffCustomConfig describes, one change per line, how the items of a
+// custom configuration changed.
+func diffCustomConfig(old string, current string) []string {
+	oldValues := map[string]string{}
+	oldOrder := []string{}
+	for _, line := range customConfigLines(old) {
+		k, v := splitCustomConfigItem(line)
+		oldValues[k] = v
+		oldOrder = append(oldOrder, k)
+	}
+	changes := []string{}
+	newValues := map[string]string{}
+	newOrder := []string{}
+	for _, line := range customConfigLines(current) {
+		k, v := splitCustomConfigItem(line)
+		newValues[k] = v
+		newOrder = append(newOrder, k)
+		existing, ok := oldValues[k]
+		switch {
+		case !ok:
+			changes = append(changes, "added "+line)
+		case existing != v:
+			changes = append(changes, fmt.Sprintf("changed %s from %s to %s", k, existing, v))
+		}
+	}
+	for _, k := range oldOrder {
+		if _, ok := newValues[k]; !ok {
+			changes = append(changes, strings.TrimSpace("removed "+k+" "+oldValues[k]))
+		}
+	}
+	// Patches and scripts are applied in order, so reordering them is a
+	// change too.
+	for _, kind := range []string{"patch", "script"} {
+		kept := func(order []string, other map[string]string) []string {
+			result := []string{}
+			for _, k := range order {
+				if _, ok := other[k]; ok && strings.HasPrefix(k, kind+" ") {
+					result = append(result, k)
+				}
+			}
+			return result
+		}
+		if strings.Join(kept(oldOrder, newValues), "\n") != strings.Join(kept(newOrder, oldValues), "\n") {
+			changes = append(changes, fmt.Sprintf("changed the order of the %ses", kind))
+		}
+	}
+	return changes
+}
+
+func customConfigFingerprintCommand(args []string) error {
+	flags := flag.NewFlagSet("custom-config fingerprint", flag.ExitOnError)
+	flags.Parse(args)
+	items, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	fmt.Println(customConfigFingerprint(string(items)))
+	return nil
+}
+
+func printCustomConfigDiff(w io.Writer, old string, current string) {
+	changes := diffCustomConfig(old, current)
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "The custom configuration did not change.\n")
+		return
+	}
+	fmt.Fprintf(w, "The custom configuration changed from the last build:\n")
+	for _, c := range changes {
+		fmt.Fprintf(w, "  - %s\n", c)
+	}
+}
+
+func customConfigDiffCommand(args []string) error {
+	flags := flag.NewFlagSet("custom-config diff", flag.ExitOnError)
+	oldPath := flags.String("old", "", "file with the items of the custom configuration of the last build")
+	flags.Parse(args)
+	if *oldPath == "" {
+		return fmt.Errorf("the -old option is mandatory")
+	}
+	old, err := ioutil.ReadFile(*oldPath)
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	printCustomConfigDiff(os.Stdout, string(old), string(current))
+	return nil
+}
+
+func customConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("custom-config", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s custom-config <fingerprint|diff -old <file>> < items\n\nFingerprints the items of a custom configuration, or tells how they\nchanged from those in a file.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "fingerprint":
+		return customConfigFingerprintCommand(rest)
+	case "diff":
+		return customConfigDiffCommand(rest)
+	}
+	return fmt.Errorf("unknown custom-config subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["custom-config"] = customConfigCommand
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gcItem is something in the workspace that the garbage collector would
+// remove, and why.
+type gcItem struct {
+	path   string
+	reason string
+	size   int64
+}
+
+// gcLevels are the things gc -clean can remove outright, whatever their
+// age, and the paths (relative to the workspace) they are kept in.
+var gcLevels = map[string]func(*gcPolicy) []string{
+	"aosp-out": func(p *gcPolicy) []string {
+		return []string{filepath.Join(p.buildDir, "out")}
+	},
+	"chromium-out": func(p *gcPolicy) []string {
+		return []string{filepath.Join("chromium", "src", "out", "Default")}
+	},
+	"vendor": func(p *gcPolicy) []string {
+		return []string{"vendor-in", filepath.Join(p.buildDir, "vendor", "google_devices")}
+	},
+	"kernel": func(p *gcPolicy) []string {
+		return []string{"kernel-out"}
+	},
+}
+
+type gcPolicy struct {
+	workspace string
+	buildDir  string
+	// keepBuilds is the number of builds whose inter-stage files are kept.
+	keepBuilds int
+	// keepVendor is the number of vendor builds kept for every device.
+	keepVendor int
+	// keepReleases is the number of releases of each kind kept for every
+	// device, besides those of the last successful build.
+	keepReleases int
+	// maxAge is how long unused checkouts, kernel output and stage
+	// checkpoints are kept.
+	maxAge time.Duration
+	// retention applies the policies above; without it, only the cleaning
+	// levels remove anything.
+	retention bool
+	levels    []string
+	now       time.Time
+}
+
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func (p *gcPolicy) abs(rel string) string {
+	return filepath.Join(p.workspace, rel)
+}
+
+// newestFirst sorts paths by modification time, newest first.  Paths that
+// cannot be examined sort last.
+func newestFirst(paths []string) []string {
+	mtimes := map[string]time.Time{}
+	for _, path := range paths {
+		if info, err := os.Lstat(path); err == nil {
+			mtimes[path] = info.ModTime()
+		}
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return mtimes[paths[i]].After(mtimes[paths[j]])
+	})
+	return paths
+}
+
+func (p *gcPolicy) olderThanMaxAge(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && p.now.Sub(info.ModTime()) > p.maxAge
+}
+
+// interstageItems are the inter-stage variables, artifact lists,
+// verification reports, merged hosts files and stage checkpoints of old
+// builds.
+func (p *gcPolicy) interstageItems() []gcItem {
+	dir := p.abs(filepath.Join("s3", "interstage"))
+	items := []gcItem{}
+	byBuild := map[string][]string{}
+	lastUsed := map[string]time.Time{}
+	builds := []string{}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.*"))
+	for _, m := range matches {
+		base := filepath.Base(m)
+		var build string
+		switch {
+		case strings.HasPrefix(base, "env."):
+			build = strings.SplitN(strings.TrimPrefix(base, "env."), ".", 2)[0]
+		case strings.HasPrefix(base, "artifacts."):
+			build = strings.TrimPrefix(base, "artifacts.")
+		case strings.HasPrefix(base, "verification."):
+			build = strings.TrimSuffix(strings.TrimPrefix(base, "verification."), ".jsonl")
+		case strings.HasPrefix(base, "hosts."):
+			build = strings.TrimPrefix(base, "hosts.")
+		default:
+			continue
+		}
+		if _, ok := byBuild[build]; !ok {
+			builds = append(builds, build)
+		}
+		byBuild[build] = append(byBuild[build], m)
+		if info, err := os.Lstat(m); err == nil && info.ModTime().After(lastUsed[build]) {
+			lastUsed[build] = info.ModTime()
+		}
+	}
+	sort.SliceStable(builds, func(i, j int) bool {
+		return lastUsed[builds[i]].After(lastUsed[builds[j]])
+	})
+	for i, build := range builds {
+		if i < p.keepBuilds {
+			continue
+		}
+		for _, m := range byBuild[build] {
+			items = append(items, gcItem{m, fmt.Sprintf("inter-stage file of build %s, older than the last %d builds", build, p.keepBuilds), 0})
+		}
+	}
+	checkpoints, _ := filepath.Glob(filepath.Join(dir, "checkpoints", "*"))
+	for _, c := range checkpoints {
+		if p.olderThanMaxAge(c) {
+			items = append(items, gcItem{c, "stage checkpoints unused for longer than " + p.maxAge.String(), 0})
+		}
+	}
+	return items
+}
+
+// vendorItems are the vendor files extracted for all but the most recent
+// builds of every device.
+func (p *gcPolicy) vendorItems() []gcItem {
+	items := []gcItem{}
+	devices, _ := ioutil.ReadDir(p.abs("vendor-in"))
+	for _, d := range devices {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		builds, _ := filepath.Glob(filepath.Join(p.abs("vendor-in"), d.Name(), "*"))
+		for i, b := range newestFirst(builds) {
+			if i < p.keepVendor {
+				continue
+			}
+			items = append(items, gcItem{b, fmt.Sprintf("vendor files of %s, older than the last %d", d.Name(), p.keepVendor), 0})
+			_, manifest, marker := vendorPaths(p.abs("vendor-in"), d.Name(), filepath.Base(b))
+			for _, m := range []string{manifest, marker} {
+				if _, err := os.Lstat(m); err == nil {
+					items = append(items, gcItem{m, "manifest of removed vendor files", 0})
+				}
+			}
+		}
+	}
+	return items
+}
+
+// unusedItems are kernel outputs and Chromium checkouts not used for a while.
+func (p *gcPolicy) unusedItems() []gcItem {
+	items := []gcItem{}
+	kernels, _ := filepath.Glob(filepath.Join(p.abs("kernel-out"), "*"))
+	for _, k := range kernels {
+		if p.olderThanMaxAge(k) {
+			items = append(items, gcItem{k, "kernel output unused for longer than " + p.maxAge.String(), 0})
+		}
+	}
+	// A checkout is used whenever it is fetched, moved to a new revision
+	// or built.
+	chromium := p.abs("chromium")
+	used := false
+	found := false
+	for _, marker := range []string{".fetched", ".depsrev", filepath.Join("src", "out", "Default", ".ninja_log")} {
+		if _, err := os.Lstat(filepath.Join(chromium, marker)); err == nil {
+			found = true
+			if !p.olderThanMaxAge(filepath.Join(chromium, marker)) {
+				used = true
+			}
+		}
+	}
+	if found && !used {
+		items = append(items, gcItem{chromium, "Chromium checkout unused for longer than " + p.maxAge.String(), 0})
+	}
+	return items
+}
+
+// releaseFile matches the files of a release that are made anew (with a
+// new name) by every build.
+var releaseFile = regexp.MustCompile(`^(.+)-(ota_update|incremental|target_files|factory)-(.+)\.(zip|tar\.xz)$`)
+
+// releaseItems are releases older than the last few of each kind, except
+// for those of the last successful build.
+func (p *gcPolicy) releaseItems() []gcItem {
+	items := []gcItem{}
+	buckets, _ := filepath.Glob(p.abs(filepath.Join("s3", "*-release")))
+	for _, bucket := range buckets {
+		protected := map[string]bool{}
+		if state, err := loadBuildState(filepath.Join(bucket, "build-state.json")); err == nil {
+			if b := state.latest(); b != nil {
+				for _, a := range b.Artifacts {
+					protected[filepath.Base(a.Path)] = true
+				}
+			}
+		}
+		groups := map[string][]string{}
+		files, _ := ioutil.ReadDir(bucket)
+		for _, f := range files {
+			m := releaseFile.FindStringSubmatch(f.Name())
+			if f.IsDir() || m == nil || strings.Contains(m[3], "latest") {
+				continue
+			}
+			group := m[1] + " " + m[2]
+			groups[group] = append(groups[group], filepath.Join(bucket, f.Name()))
+		}
+		for group, paths := range groups {
+			for i, path := range newestFirst(paths) {
+				if i < p.keepReleases || protected[filepath.Base(path)] {
+					continue
+				}
+				items = append(items, gcItem{path, fmt.Sprintf("%s release older than the last %d", group, p.keepReleases), 0})
+			}
+		}
+	}
+	return items
+}
+
+// levelItems are the things selected for removal with -clean.
+func (p *gcPolicy) levelItems() ([]gcItem, error) {
+	items := []gcItem{}
+	for _, level := range p.levels {
+		names := []string{level}
+		if level == "all" {
+			names = []string{}
+			for name := range gcLevels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			paths, ok := gcLevels[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cleaning level %q", name)
+			}
+			for _, rel := range paths(p) {
+				if _, err := os.Lstat(p.abs(rel)); err == nil {
+					items = append(items, gcItem{p.abs(rel), "cleaning level " + name, 0})
+				}
+			}
+		}
+	}
+	return items, nil
+}
+
+// collect returns everything the policy says should be removed.  Paths
+// that are within another path to be removed are left out.
+func (p *gcPolicy) collect() ([]gcItem, error) {
+	items, err := p.levelItems()
+	if err != nil {
+		return nil, err
+	}
+	if p.retention {
+		items = append(items, p.interstageItems()...)
+		items = append(items, p.vendorItems()...)
+		items = append(items, p.unusedItems()...)
+		items = append(items, p.releaseItems()...)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].path < items[j].path })
+	result := []gcItem{}
+	for _, item := range items {
+		if n := len(result); n > 0 {
+			last := result[n-1].path
+			if item.path == last || strings.HasPrefix(item.path, last+string(filepath.Separator)) {
+				continue
+			}
+		}
+		item.size = diskUsage(item.path)
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+func collectGarbage(w io.Writer, p *gcPolicy, dryRun bool) error {
+	items, err := p.collect()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, item := range items {
+		rel, err := filepath.Rel(p.workspace, item.path)
+		if err != nil {
+			rel = item.path
+		}
+		fmt.Fprintf(w, "%12d  %s  (%s)\n", item.size, rel, item.reason)
+		total += item.size
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(item.path); err != nil {
+			return err
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(w, "%d bytes reclaimable.\n", total)
+	} else {
+		fmt.Fprintf(w, "%d bytes reclaimed.\n", total)
+	}
+	return nil
+}
+
+func gcCommand(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	p := &gcPolicy{now: time.Now()}
+	flags.StringVar(&p.workspace, "workspace", ".", "directory the build script runs in (the one containing s3/)")
+	flags.StringVar(&p.buildDir, "build-dir", "rattlesnake-os", "AOSP source tree, relative to the workspace")
+	flags.IntVar(&p.keepBuilds, "keep-builds", 5, "number of builds whose inter-stage files are kept")
+	flags.IntVar(&p.keepVendor, "keep-vendor", 2, "number of extracted vendor builds kept for every device, including the one in use")
+	flags.IntVar(&p.keepReleases, "keep-releases", 3, "number of releases of each kind kept for every device")
+	flags.DurationVar(&p.maxAge, "max-age", 30*24*time.Hour, "how long unused Chromium checkouts, kernel output and stage checkpoints are kept")
+	flags.BoolVar(&p.retention, "retention", true, "remove what the policies above do not keep (with -retention=false, only what -clean selects is removed)")
+	clean := flags.String("clean", "", "comma-separated list of things to remove regardless of the policies above: aosp-out, chromium-out, vendor, kernel or all")
+	dryRun := flags.Bool("n", false, "only report what would be removed, and how many bytes that would reclaim")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s gc [options]\n\nRemoves old build products and downloads from the workspace.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	for _, level := range strings.Split(*clean, ",") {
+		if level = strings.TrimSpace(level); level != "" {
+			p.levels = append(p.levels, level)
+		}
+	}
+	workspace, err := filepath.Abs(p.workspace)
+	if err != nil {
+		return err
+	}
+	p.workspace = workspace
+	return collectGarbage(os.Stdout, p, *dryRun)
+}
+
+func init() {
+	subcommands["gc"] = gcCommand
+}
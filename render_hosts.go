@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// stockHosts are the entries of the hosts file of AOSP, which the merged
+// hosts file starts with.
+var stockHosts = []hostsEntry{
+	{"127.0.0.1", "localhost"},
+	{"::1", "ip6-localhost"},
+}
+
+// reservedHostNames are names that hosts file lists map to loopback or
+// special addresses for the benefit of the systems they were made for.
+// They are left out, in favor of the stock entries.
+var reservedHostNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+var hostName = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]*[a-z0-9_])?\.)*[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?\.?$`)
+
+type hostsEntry struct {
+	Address string
+	Name    string
+}
+
+// isHostsURL tells URLs of hosts files apart from local paths.
+func isHostsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func openHostsSource(source string) (io.ReadCloser, error) {
+	if !isHostsURL(source) {
+		return os.Open(source)
+	}
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", source, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseHosts reads the entries of a hosts file, failing on lines that are
+// not an address followed by host names.
+func parseHosts(r io.Reader, source string) ([]hostsEntry, error) {
+	entries := []hostsEntry{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		address := fields[0]
+		// Link-local addresses may name the interface they are on.
+		if ip := net.ParseIP(strings.SplitN(address, "%", 2)[0]); ip == nil {
+			return nil, fmt.Errorf("%s:%d: %q is not an IP address", source, n, address)
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: address %s has no host names", source, n, address)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(name)
+			if !hostName.MatchString(name) {
+				return nil, fmt.Errorf("%s:%d: %q is not a host name", source, n, name)
+			}
+			entries = append(entries, hostsEntry{address, strings.TrimSuffix(name, ".")})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// hostsAllowlist are host names left out of the hosts file.  A name
+// written as *.example.com covers the names under example.com, but not
+// example.com itself.
+type hostsAllowlist struct {
+	names   map[string]bool
+	domains []string
+}
+
+func (a *hostsAllowlist) read(path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for n, line := range strings.Split(string(contents), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		name := strings.ToLower(strings.TrimSpace(line))
+		if name == "" {
+			continue
+		}
+		domain := strings.TrimPrefix(name, "*.")
+		if !hostName.MatchString(domain) {
+			return fmt.Errorf("%s:%d: %q is not a host name", path, n+1, name)
+		}
+		domain = strings.TrimSuffix(domain, ".")
+		if domain != name {
+			a.domains = append(a.domains, "."+domain)
+		} else {
+			a.names[domain] = true
+		}
+	}
+	return nil
+}
+
+func (a *hostsAllowlist) allows(name string) bool {
+	if a.names[name] {
+		return true
+	}
+	for _, d := range a.domains {
+		if strings.HasSuffix(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostsReport tells what went into a merged hosts file.
+type hostsReport struct {
+	Sources     int
+	Entries     int
+	Duplicates  int
+	Allowlisted int
+	Reserved    int
+	SHA256      string
+}
+
+// mergeHosts merges hosts files into one, after the stock entries.  A host
+// name keeps the first address of each family it is given, so that
+// duplicates across lists do not grow the file.
+func mergeHosts(sources []string, allow *hostsAllowlist, w io.Writer) (*hostsReport, error) {
+	report := &hostsReport{Sources: len(sources)}
+	seen := map[string]bool{}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# Merged from %d hosts files by the build.\n", len(sources))
+	add := func(e hostsEntry) {
+		family := "4"
+		if strings.Contains(e.Address, ":") {
+			family = "6"
+		}
+		if seen[family+" "+e.Name] {
+			report.Duplicates++
+			return
+		}
+		seen[family+" "+e.Name] = true
+		report.Entries++
+		fmt.Fprintf(buf, "%s %s\n", e.Address, e.Name)
+	}
+	for _, e := range stockHosts {
+		add(e)
+	}
+	for _, source := range sources {
+		r, err := openHostsSource(source)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseHosts(r, source)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			switch {
+			case reservedHostNames[e.Name]:
+				report.Reserved++
+			case allow.allows(e.Name):
+				report.Allowlisted++
+			default:
+				add(e)
+			}
+		}
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	report.SHA256 = hex.EncodeToString(sum[:])
+	_, err := buf.WriteTo(w)
+	return report, err
+}
+
+// checkHostsConfig fails early on local hosts files and allowlists that are
+// missing or malformed, before the build script is written.
+func checkHostsConfig(sources []string, allowlists []string) error {
+	allow := &hostsAllowlist{names: map[string]bool{}}
+	for _, path := range allowlists {
+		if err := allow.read(path); err != nil {
+			return err
+		}
+	}
+	for _, source := range sources {
+		if isHostsURL(source) {
+			continue
+		}
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		_, err = parseHosts(f, source)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hostsCommand(args []string) error {
+	flags := flag.NewFlagSet("hosts", flag.ExitOnError)
+	sources := listFlag{}
+	allowlists := listFlag{}
+	flags.Var(&sources, "source", "hosts file to merge, a local path or an http(s) URL (repeatable)")
+	flags.Var(&allowlists, "allowlist", "file of host names (or *.domain patterns) to leave out, one per line (repeatable)")
+	output := flags.String("output", "", "path to write the merged hosts file to")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s hosts -output hosts -source <path|URL> [-source ...] [-allowlist file ...]\n\nMerges hosts files into one, without duplicates or allowlisted host names, after the stock entries of AOSP.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *output == "" || len(sources) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	allow := &hostsAllowlist{names: map[string]bool{}}
+	for _, path := range allowlists {
+		if err := allow.read(path); err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	report, err := mergeHosts(sources, allow, buf)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(*output, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d hosts files into %d entries (left out %d duplicates, %d allowlisted and %d reserved names), sha256 %s\n",
+		report.Sources, report.Entries, report.Duplicates, report.Allowlisted, report.Reserved, report.SHA256)
+	return nil
+}
+
+func init() {
+	subcommands["hosts"] = hostsCommand
+}
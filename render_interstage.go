@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// interstageVersion is the version of the inter-stage variables file format.
+const interstageVersion = 1
+
+// interstageVariables are the variables that the first stage of a build
+// computes (chosen versions, reasons to build...) and that later stages,
+// each run by a separate invocation of the build script, reload.
+type interstageVariables struct {
+	Version int                 `json:"version"`
+	Strings map[string]string   `json:"strings"`
+	Lists   map[string][]string `json:"lists"`
+}
+
+var shellVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sensitiveVariableName matches the names of variables whose values are
+// redacted from environment dumps.
+var sensitiveVariableName = regexp.MustCompile(`(?i)(KEY|SECRET|PASS|TOKEN|CREDENTIAL|AUTH|COOKIE)`)
+
+// shellQuote quotes s so that the shell reads it back verbatim, whatever
+// quotes, expansions or newlines it contains.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func loadInterstage(path string) (*interstageVariables, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars := &interstageVariables{}
+	if err := json.Unmarshal(contents, vars); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if vars.Version > interstageVersion {
+		return nil, fmt.Errorf("%s: inter-stage variables version %d is newer than the supported version %d", path, vars.Version, interstageVersion)
+	}
+	for name := range vars.Strings {
+		if !shellVariableName.MatchString(name) {
+			return nil, fmt.Errorf("%s: %q is not a valid variable name", path, name)
+		}
+	}
+	for name := range vars.Lists {
+		if !shellVariableName.MatchString(name) {
+			return nil, fmt.Errorf("%s: %q is not a valid variable name", path, name)
+		}
+	}
+	return vars, nil
+}
+
+// latestInterstage returns the most recently saved inter-stage variables in
+// a directory, and the file they were read from.
+func latestInterstage(dir string) (*interstageVariables, string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "env.*.json"))
+	if err != nil {
+		return nil, "", err
+	}
+	var latest string
+	var latestInfo os.FileInfo
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			return nil, "", err
+		}
+		if latestInfo == nil || info.ModTime().After(latestInfo.ModTime()) {
+			latest, latestInfo = m, info
+		}
+	}
+	if latest == "" {
+		return nil, "", nil
+	}
+	vars, err := loadInterstage(latest)
+	return vars, latest, err
+}
+
+// stringListFlag collects -list NAME (declaring a possibly empty list) and
+// -list NAME=value (appending value to the list) options.
+type stringListFlag map[string][]string
+
+func (f stringListFlag) String() string {
+	return fmt.Sprintf("%v", map[string][]string(f))
+}
+
+func (f stringListFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if _, ok := f[parts[0]]; !ok {
+		f[parts[0]] = []string{}
+	}
+	if len(parts) == 2 {
+		f[parts[0]] = append(f[parts[0]], parts[1])
+	}
+	return nil
+}
+
+func interstageSave(path string, args []string) error {
+	flags := flag.NewFlagSet("interstage save", flag.ExitOnError)
+	strs := keyValueFlag{}
+	lists := stringListFlag{}
+	flags.Var(strs, "var", "NAME=value string variable to save (repeatable)")
+	flags.Var(lists, "list", "NAME declares a list variable to save, NAME=value appends to it (repeatable)")
+	flags.Parse(args)
+
+	vars := &interstageVariables{Version: interstageVersion, Strings: strs, Lists: lists}
+	for name := range strs {
+		if !shellVariableName.MatchString(name) {
+			return fmt.Errorf("%q is not a valid variable name", name)
+		}
+	}
+	for name := range lists {
+		if !shellVariableName.MatchString(name) {
+			return fmt.Errorf("%q is not a valid variable name", name)
+		}
+	}
+	contents, err := json.MarshalIndent(vars, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, append(contents, '\n'), 0644)
+}
+
+// interstageLoad prints shell assignments that restore the saved variables
+// as globals, even when evaluated within a function.
+func interstageLoad(path string, args []string) error {
+	flags := flag.NewFlagSet("interstage load", flag.ExitOnError)
+	required := flags.String("require", "", "comma-separated names of variables that must have been saved with a non-empty value")
+	flags.Parse(args)
+
+	vars, err := loadInterstage(path)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, name := range strings.Split(*required, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if vars.Strings[name] == "" && len(vars.Lists[name]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: required variables missing or empty: %s", path, strings.Join(missing, ", "))
+	}
+
+	names := []string{}
+	for name := range vars.Strings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("declare -g %s=%s\n", name, shellQuote(vars.Strings[name]))
+	}
+	names = []string{}
+	for name := range vars.Lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		quoted := []string{}
+		for _, v := range vars.Lists[name] {
+			quoted = append(quoted, shellQuote(v))
+		}
+		fmt.Printf("declare -ga %s=(%s)\n", name, strings.Join(quoted, " "))
+	}
+	return nil
+}
+
+// interstageEnv prints the environment, with the values of variables that
+// look like they hold credentials redacted.
+func interstageEnv(args []string) error {
+	flags := flag.NewFlagSet("interstage env", flag.ExitOnError)
+	flags.Parse(args)
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && sensitiveVariableName.MatchString(parts[0]) {
+			kv = parts[0] + "=<redacted>"
+		}
+		fmt.Println(strings.Replace(kv, "\n", `\n`, -1))
+	}
+	return nil
+}
+
+func interstageCommand(args []string) error {
+	flags := flag.NewFlagSet("interstage", flag.ExitOnError)
+	file := flags.String("file", "", "path to the inter-stage variables file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s interstage [-file env.json] <save|load|env> [options]\n\nSaves and restores the variables shared by the stages of a build.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	if flags.Arg(0) == "env" {
+		return interstageEnv(rest)
+	}
+	if *file == "" {
+		return fmt.Errorf("the -file option is mandatory")
+	}
+	switch flags.Arg(0) {
+	case "save":
+		return interstageSave(*file, rest)
+	case "load":
+		return interstageLoad(*file, rest)
+	}
+	return fmt.Errorf("unknown interstage subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["interstage"] = interstageCommand
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// patchSection is the part of a patch that changes one file.
+type patchSection struct {
+	// path is the path of the file in the tree, as patch -p1 (which the
+	// build script applies custom patches with) finds it.
+	path  string
+	lines []string
+	hunks []patchHunk
+}
+
+type patchHunk struct {
+	lines []string
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// stripPatchPath removes the first component of a path in a patch, as
+// patch -p1 does.
+func stripPatchPath(path string) string {
+	if i := strings.Index(path, "\t"); i >= 0 {
+		path = path[:i]
+	}
+	if path == "/dev/null" {
+		return ""
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+// parsePatch splits a patch, such as one made by git format-patch or
+// diff -u, into the sections that change each file.  Anything before the
+// first section, such as the commit message, is left out.
+func parsePatch(r io.Reader) ([]*patchSection, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sections := []*patchSection{}
+	var current *patchSection
+	// inHeader is set between diff --git and the first hunk of a section,
+	// and remainingOld and remainingNew count the lines left in the hunk.
+	inHeader := false
+	remainingOld, remainingNew := 0, 0
+	for i, line := range lines {
+		switch {
+		case current != nil && (remainingOld > 0 || remainingNew > 0):
+			switch {
+			case strings.HasPrefix(line, "-"):
+				remainingOld--
+			case strings.HasPrefix(line, "+"):
+				remainingNew--
+			case strings.HasPrefix(line, "\\"):
+			default:
+				remainingOld--
+				remainingNew--
+			}
+			h := &current.hunks[len(current.hunks)-1]
+			h.lines = append(h.lines, line)
+			current.lines = append(current.lines, line)
+			continue
+		case strings.HasPrefix(line, "diff --git "):
+			current = &patchSection{}
+			if fields := strings.Fields(line); len(fields) == 4 {
+				current.path = stripPatchPath(fields[3])
+			}
+			sections = append(sections, current)
+			inHeader = true
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if !inHeader {
+				current = &patchSection{}
+				sections = append(sections, current)
+			}
+			if path := stripPatchPath(strings.TrimPrefix(line, "--- ")); path != "" {
+				current.path = path
+			}
+		case strings.HasPrefix(line, "+++ ") && current != nil:
+			if path := stripPatchPath(strings.TrimPrefix(line, "+++ ")); path != "" {
+				current.path = path
+			}
+		case current != nil && strings.HasPrefix(line, "@@ "):
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: malformed hunk header %q", i+1, line)
+			}
+			remainingOld, remainingNew = 1, 1
+			if m[1] != "" {
+				remainingOld, _ = strconv.Atoi(m[1])
+			}
+			if m[2] != "" {
+				remainingNew, _ = strconv.Atoi(m[2])
+			}
+			current.hunks = append(current.hunks, patchHunk{[]string{line}})
+			inHeader = false
+		}
+		if current != nil {
+			current.lines = append(current.lines, line)
+		}
+	}
+	for _, s := range sections {
+		if s.path == "" {
+			return nil, fmt.Errorf("a section of the patch names no file")
+		}
+	}
+	return sections, nil
+}
+
+// repoProjects returns the paths of the projects in a tree checked out by
+// repo, longest first, so that the first one a file is in is its project.
+func repoProjects(tree string) ([]string, error) {
+	projects, err := readLines(filepath.Join(tree, ".repo", "project.list"))
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(projects, func(i, j int) bool { return len(projects[i]) > len(projects[j]) })
+	return projects, nil
+}
+
+func projectOf(projects []string, path string) string {
+	for _, p := range projects {
+		if strings.HasPrefix(path, p+"/") {
+			return p
+		}
+	}
+	return ""
+}
+
+// patchChecker checks custom patches against a tree, in the order the
+// build applies them, as if every earlier patch that applies had been
+// applied.  Patches are applied with patch -p1, as the build applies them,
+// to copies of the files they change in a scratch directory.
+type patchChecker struct {
+	tree     string
+	projects []string
+	// scratch has the files of the tree changed by the patches checked so
+	// far, with the changes of those that apply.
+	scratch string
+	copied  map[string]bool
+}
+
+type patchConflict struct {
+	patch   string
+	message string
+	hunks   []string
+}
+
+var (
+	patchingFile = regexp.MustCompile(`^(?:checking|patching) file (.+)$`)
+	hunkFailed   = regexp.MustCompile(`^Hunk #(\d+) FAILED at \d+`)
+)
+
+// patchArgs are the options of patch the build applies custom patches
+// with.  The build has no terminal, so patch asks nothing and takes the
+// default answers, which --batch --forward stand for here.
+var patchArgs = []string{"-p1", "--no-backup-if-mismatch", "--batch", "--forward"}
+
+// runPatch runs patch in the scratch directory, and returns its output and
+// whether the patch applies.
+func (c *patchChecker) runPatch(file string, args ...string) (string, bool, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return "", false, err
+	}
+	cmd := exec.Command("patch", append(append(append([]string{}, patchArgs...), args...), "-i", file)...)
+	cmd.Dir = c.scratch
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err == nil {
+		return output.String(), true, nil
+	} else if _, ok := err.(*exec.ExitError); !ok {
+		return "", false, err
+	}
+	return output.String(), false, nil
+}
+
+// check checks the patch in a file, and reports it by name.
+func (c *patchChecker) check(file string, patch string) ([]patchConflict, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := parsePatch(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", patch, err)
+	}
+	if len(sections) == 0 {
+		return []patchConflict{{patch, "there are no changes in the patch", nil}}, nil
+	}
+	conflicts := []patchConflict{}
+	for _, s := range sections {
+		if projectOf(c.projects, s.path) == "" {
+			conflicts = append(conflicts, patchConflict{patch, s.path + " is not in any project of the tree", nil})
+		}
+		if c.copied[s.path] {
+			continue
+		}
+		c.copied[s.path] = true
+		contents, err := ioutil.ReadFile(filepath.Join(c.tree, s.path))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(c.scratch, s.path)), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(c.scratch, s.path), contents, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	output, ok, err := c.runPatch(file, "--dry-run")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// Later patches are checked on top of this one.
+		if output, ok, err := c.runPatch(file); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%s applies with --dry-run but not without:\n%s", patch, output)
+		}
+		return conflicts, nil
+	}
+	conflict := patchConflict{patch, fmt.Sprintf("does not apply:\n%s", strings.TrimRight(output, "\n")), nil}
+	path := ""
+	for _, line := range strings.Split(output, "\n") {
+		if m := patchingFile.FindStringSubmatch(line); m != nil {
+			path = m[1]
+			continue
+		}
+		m := hunkFailed.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		for _, s := range sections {
+			if s.path == path && n <= len(s.hunks) {
+				conflict.hunks = append(conflict.hunks, s.path+"\n"+strings.Join(s.hunks[n-1].lines, "\n"))
+			}
+		}
+	}
+	return append(conflicts, conflict), nil
+}
+
+// customPatchFiles returns the files of the custom patches of the
+// configuration, in the order the build applies them, and their names.
+// Patches in remote repositories are taken from clones in dir.
+func customPatchFiles(config *myStackConfig, dir string) ([]string, []string, error) {
+	files := []string{}
+	names := []string{}
+	if config.CustomPatches == nil {
+		return files, names, nil
+	}
+	for _, r := range *config.CustomPatches {
+		source := r.Repo
+		name := r.Repo + " "
+		if local, ok := config.CustomLocalDirs[r.Repo]; ok {
+			name = filepath.Clean(local.Source) + "/"
+		} else {
+			source = filepath.Join(dir, mirrorName(r.Repo))
+			if _, err := os.Stat(source); os.IsNotExist(err) {
+				if err := runGit(dir, "clone", "--quiet", config.repoURL(r.Repo), source); err != nil {
+					return nil, nil, err
+				}
+				if revision, ok := config.CustomRevisions[r.Repo]; ok {
+					if err := runGit(source, "checkout", "--quiet", revision); err != nil {
+						return nil, nil, err
+					}
+				}
+			}
+		}
+		for _, patch := range r.Patches {
+			files = append(files, filepath.Join(source, patch))
+			names = append(names, name+patch)
+		}
+	}
+	return files, names, nil
+}
+
+func patchCheckCommand(args []string) error {
+	flags := flag.NewFlagSet("patch-check", flag.ExitOnError)
+	tree := flags.String("tree", "rattlesnake-os", "AOSP source tree, synced by repo")
+	// Without patch files, the patches are those of the configuration,
+	// described with the same options used to render the build script.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if f.Name != "output" {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s patch-check -tree <AOSP tree> [options] [patch...]\n\nChecks that custom patches apply to a synced AOSP tree, without applying\nthem, and reports every one that does not.  Without patch files, checks\nthe custom patches of the configuration.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	patches := flags.Args()
+	names := patches
+	if len(patches) == 0 {
+		tmp, err := ioutil.TempDir("", "patch-check.")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*output = filepath.Join(tmp, filepath.Base(*output))
+		config, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if patches, names, err = customPatchFiles(config, tmp); err != nil {
+			return err
+		}
+	}
+	projects, err := repoProjects(*tree)
+	if err != nil {
+		return fmt.Errorf("cannot list the projects of %s, which must be synced by repo: %v", *tree, err)
+	}
+	scratch, err := ioutil.TempDir("", "patch-check-tree.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+	c := &patchChecker{tree: *tree, projects: projects, scratch: scratch, copied: map[string]bool{}}
+	failed := 0
+	for i, patch := range patches {
+		conflicts, err := c.check(patch, names[i])
+		if err != nil {
+			return err
+		}
+		if len(conflicts) == 0 {
+			fmt.Printf("ok        %s\n", names[i])
+			continue
+		}
+		failed++
+		for _, conflict := range conflicts {
+			fmt.Printf("CONFLICT  %s %s\n", conflict.patch, conflict.message)
+			for _, h := range conflict.hunks {
+				fmt.Printf("  Offending hunk in %s\n", strings.Replace(h, "\n", "\n    ", -1))
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d custom patches do not apply to %s", failed, len(patches), *tree)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["patch-check"] = patchCheckCommand
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// productConfig is the part of the custom configuration that changes the
+// product rather than its sources: build properties, the name and version
+// the OS displays, defaults of settings, resource overlays and packages
+// removed from the product.  The renderer makes it into a vendor directory
+// of its own, with a product makefile, which the build puts into the tree.
+type productConfig struct {
+	// Properties are properties of /system/build.prop: the ro.* and
+	// persist.* ones of the custom configuration, and the release channel
+	// of the Updater.
+	Properties map[string]string
+	OSName     string
+	OSVersion  string
+	// Settings are the defaults of settings, by namespace (global or
+	// secure) and name.
+	Settings map[string]map[string]string
+	// Overlays are the values of resources, by the path of the package in
+	// the tree and type/name of the resource.
+	Overlays map[string]map[string]overlayValue
+	// RemovePackages are modules taken out of PRODUCT_PACKAGES.
+	RemovePackages []string
+}
+
+// overlayValue is a resource value, and the type of resource it is.
+type overlayValue struct {
+	Type  string
+	Value interface{}
+}
+
+// The directory of the tree the build puts the product configuration in,
+// which is not in any project, so that syncing the tree leaves it alone.
+const productConfigTreeDir = "vendor/custom-config"
+
+func (p *productConfig) empty() bool {
+	return !p.needsMakefile() && len(p.Settings) == 0 && len(p.RemovePackages) == 0
+}
+
+// needsMakefile tells whether there is anything for the product makefile
+// to do.  Settings and removed packages are changes to the tree instead.
+func (p *productConfig) needsMakefile() bool {
+	return len(p.Properties) > 0 || p.OSName != "" || p.OSVersion != "" || len(p.Overlays) > 0
+}
+
+// Removes tells whether a module is removed from the product.
+func (p *productConfig) Removes(module string) bool {
+	for _, m := range p.RemovePackages {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	propertyName = regexp.MustCompile(`^(ro|persist)\.[A-Za-z0-9_.-]+$`)
+	settingName  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	resourceName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	moduleName   = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+)
+
+// resourceTypes are the types of resources that can be overlaid.
+var resourceTypes = map[string]bool{
+	"bool":          true,
+	"integer":       true,
+	"string":        true,
+	"dimen":         true,
+	"color":         true,
+	"fraction":      true,
+	"string-array":  true,
+	"integer-array": true,
+	"array":         true,
+}
+
+// settingsNamespaces are the namespaces of settings that take defaults,
+// and the methods of DatabaseHelper that load theirs.
+var settingsNamespaces = map[string]string{
+	"global": "loadGlobalSettings",
+	"secure": "loadSecureSettings",
+}
+
+// settingValue turns the value of a setting or property in the custom
+// configuration, which may be a string, a number or a boolean, into a
+// string.
+func settingValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// overlayValueOf makes a resource value out of its name in the custom
+// configuration, which may be prefixed by its type, as in dimen/name, and
+// its value, whose JSON type is that of the resource otherwise.
+func overlayValueOf(key string, value interface{}) (string, overlayValue, error) {
+	typ, name := "", key
+	if i := strings.Index(key, "/"); i >= 0 {
+		typ, name = key[:i], key[i+1:]
+		if !resourceTypes[typ] {
+			return "", overlayValue{}, fmt.Errorf("resource %s has unknown type %s", key, typ)
+		}
+	}
+	if !resourceName.MatchString(name) {
+		return "", overlayValue{}, fmt.Errorf("%q is not a resource name", name)
+	}
+	if typ == "" {
+		switch v := value.(type) {
+		case bool:
+			typ = "bool"
+		case float64:
+			if v != math.Trunc(v) {
+				return "", overlayValue{}, fmt.Errorf("resource %s is not an integer; write its type before its name, as in fraction/%s", name, name)
+			}
+			typ = "integer"
+		case string:
+			typ = "string"
+		case []interface{}:
+			typ = "string-array"
+			for _, item := range v {
+				if _, ok := item.(float64); ok {
+					typ = "integer-array"
+				}
+			}
+		default:
+			return "", overlayValue{}, fmt.Errorf("resource %s has a value of no resource type", name)
+		}
+	}
+	_, isList := value.([]interface{})
+	if isList != strings.HasSuffix(typ, "array") {
+		return "", overlayValue{}, fmt.Errorf("the value of %s resource %s is not of its type", typ, name)
+	}
+	return typ + "/" + name, overlayValue{typ, value}, nil
+}
+
+// customProductConfig returns the product configuration set by the
+// build-properties, os-name, os-version, settings-defaults and
+// resource-overlays members of the custom configuration, which the
+// upstream configuration structures do not have.
+func customProductConfig(m map[string]interface{}) (*productConfig, error) {
+	p := &productConfig{
+		Properties: map[string]string{},
+		Settings:   map[string]map[string]string{},
+		Overlays:   map[string]map[string]overlayValue{},
+	}
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "buildproperties":
+			properties, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("build-properties is not an object")
+			}
+			for name, value := range properties {
+				if !propertyName.MatchString(name) {
+					return nil, fmt.Errorf("build property %s is neither a ro.* nor a persist.* property", name)
+				}
+				s, ok := settingValue(value)
+				if !ok || strings.ContainsAny(s, " \t\n\\#$") {
+					return nil, fmt.Errorf("build property %s must have a value without spaces, backslashes, # or $", name)
+				}
+				p.Properties[name] = s
+			}
+		case "osname", "osversion":
+			what := "os-name"
+			if strings.ToLower(k) == "osversion" {
+				what = "os-version"
+			}
+			s, ok := v.(string)
+			if !ok || strings.ContainsAny(s, "\n\"\\`$#") {
+				return nil, fmt.Errorf("%s must be a string without double quotes, backslashes, backquotes, # or $", what)
+			}
+			if what == "os-name" {
+				p.OSName = strings.TrimSpace(s)
+			} else {
+				p.OSVersion = strings.TrimSpace(s)
+			}
+		case "settingsdefaults":
+			namespaces, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("settings-defaults is not an object")
+			}
+			for namespace, settings := range namespaces {
+				ns := strings.ToLower(namespace)
+				if _, ok := settingsNamespaces[ns]; !ok {
+					return nil, fmt.Errorf("settings-defaults has unknown namespace %s, which must be global or secure", namespace)
+				}
+				values, ok := settings.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("the %s settings defaults are not an object", namespace)
+				}
+				if p.Settings[ns] == nil {
+					p.Settings[ns] = map[string]string{}
+				}
+				for name, value := range values {
+					s, ok := settingValue(value)
+					if !ok || !settingName.MatchString(name) {
+						return nil, fmt.Errorf("%s setting %s must have a name of letters, digits, _, . and -, and a string, number or boolean value", namespace, name)
+					}
+					p.Settings[ns][name] = s
+				}
+			}
+		case "removepackages":
+			modules, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("remove-packages is not a list")
+			}
+			for _, m := range modules {
+				module, _ := m.(string)
+				if !moduleName.MatchString(module) {
+					return nil, fmt.Errorf("remove-packages has %v, which is not a module name", m)
+				}
+				if !p.Removes(module) {
+					p.RemovePackages = append(p.RemovePackages, module)
+				}
+			}
+		case "resourceoverlays":
+			packages, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("resource-overlays is not an object")
+			}
+			for pkg, resources := range packages {
+				clean := filepath.ToSlash(filepath.Clean(pkg))
+				if filepath.IsAbs(pkg) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+					return nil, fmt.Errorf("resource overlay package %s is not a path within the tree", pkg)
+				}
+				values, ok := resources.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("the resource overlays of %s are not an object", pkg)
+				}
+				if p.Overlays[clean] == nil {
+					p.Overlays[clean] = map[string]overlayValue{}
+				}
+				for name, value := range values {
+					key, o, err := overlayValueOf(name, value)
+					if err != nil {
+						return nil, fmt.Errorf("resource overlays of %s: %v", pkg, err)
+					}
+					p.Overlays[clean][key] = o
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DisplayID is the build number Settings shows in About phone, or empty to
+// leave the one the build makes.
+func (p *productConfig) DisplayID() string {
+	switch {
+	case p.OSName != "" && p.OSVersion != "":
+		return p.OSName + " " + p.OSVersion
+	case p.OSName != "":
+		return p.OSName + " $(BUILD_ID)"
+	}
+	return p.OSVersion
+}
+
+// Items are the product configuration in the canonical form of the custom
+// configuration.
+func (p *productConfig) Items() []string {
+	items := []string{}
+	for _, name := range sortedKeys(p.Properties) {
+		items = append(items, fmt.Sprintf("build-property %s %s", name, p.Properties[name]))
+	}
+	if p.OSName != "" {
+		items = append(items, "os-name "+p.OSName)
+	}
+	if p.OSVersion != "" {
+		items = append(items, "os-version "+p.OSVersion)
+	}
+	namespaces := []string{}
+	for ns := range p.Settings {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		for _, name := range sortedKeys(p.Settings[ns]) {
+			items = append(items, fmt.Sprintf("setting %s:%s %s", ns, name, p.Settings[ns][name]))
+		}
+	}
+	packages := []string{}
+	for pkg := range p.Overlays {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+	for _, pkg := range packages {
+		keys := []string{}
+		for key := range p.Overlays[pkg] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, _ := json.Marshal(p.Overlays[pkg][key].Value)
+			items = append(items, fmt.Sprintf("overlay %s:%s %s", pkg, key, value))
+		}
+	}
+	for _, module := range p.RemovePackages {
+		items = append(items, "remove-package "+module)
+	}
+	return items
+}
+
+// Args are the options of product-config that set the defaults of settings
+// and remove packages.
+func (p *productConfig) Args() string {
+	args := []string{}
+	for _, module := range p.RemovePackages {
+		args = append(args, shellQuote("-remove-package"), shellQuote(module))
+	}
+	namespaces := []string{}
+	for ns := range p.Settings {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		for _, name := range sortedKeys(p.Settings[ns]) {
+			args = append(args, shellQuote("-setting"), shellQuote(ns+":"+name+"="+p.Settings[ns][name]))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// makefile is the product makefile of the product configuration, which
+// the makefile of the device includes.
+func (p *productConfig) makefile() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Generated from the custom configuration.  Do not edit.\n")
+	if len(p.Properties) > 0 {
+		fmt.Fprintf(&b, "\nPRODUCT_SYSTEM_DEFAULT_PROPERTIES += \\\n")
+		names := sortedKeys(p.Properties)
+		for i, name := range names {
+			end := " \\"
+			if i == len(names)-1 {
+				end = ""
+			}
+			fmt.Fprintf(&b, "    %s=%s%s\n", name, p.Properties[name], end)
+		}
+	}
+	if id := p.DisplayID(); id != "" {
+		fmt.Fprintf(&b, "\nPRODUCT_BUILD_PROP_OVERRIDES += BUILD_DISPLAY_ID=\"%s\"\n", id)
+	}
+	if len(p.Overlays) > 0 {
+		// Overlays listed first take precedence over those of the device.
+		fmt.Fprintf(&b, "\nPRODUCT_PACKAGE_OVERLAYS := %s/overlay $(PRODUCT_PACKAGE_OVERLAYS)\n", productConfigTreeDir)
+	}
+	return b.Bytes()
+}
+
+// escapeResourceString escapes a string as aapt needs it in a resource.
+func escapeResourceString(s string) string {
+	var b bytes.Buffer
+	for i, r := range s {
+		switch {
+		case r == '\\' || r == '"' || r == '\'':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case i == 0 && (r == '@' || r == '?'):
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '>':
+			b.WriteString("&gt;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func resourceItem(typ string, value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return fmt.Sprintf("%v", v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if typ == "string" || typ == "string-array" || typ == "array" {
+			return escapeResourceString(v)
+		}
+		return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(v)
+	}
+	return ""
+}
+
+// overlay is the values file of the resources overlaid in a package.
+func overlay(resources map[string]overlayValue) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<!-- Generated from the custom configuration.  Do not edit. -->\n<resources>\n")
+	keys := []string{}
+	for k := range resources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o := resources[k]
+		name := k[strings.Index(k, "/")+1:]
+		items, ok := o.Value.([]interface{})
+		if !ok {
+			fmt.Fprintf(&b, "    <%s name=\"%s\">%s</%s>\n", o.Type, name, resourceItem(o.Type, o.Value), o.Type)
+			continue
+		}
+		fmt.Fprintf(&b, "    <%s name=\"%s\">\n", o.Type, name)
+		for _, item := range items {
+			fmt.Fprintf(&b, "        <item>%s</item>\n", resourceItem(o.Type, item))
+		}
+		fmt.Fprintf(&b, "    </%s>\n", o.Type)
+	}
+	fmt.Fprintf(&b, "</resources>\n")
+	return b.Bytes()
+}
+
+// writeProductConfig replaces dir with the files of the product
+// configuration, which go into the tree under productConfigTreeDir, or
+// removes it if the product configuration needs no files.
+func writeProductConfig(p *productConfig, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if !p.needsMakefile() {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(filepath.Join(dir, "custom-config.mk"), p.makefile(), 0644); err != nil {
+		return err
+	}
+	for pkg, resources := range p.Overlays {
+		values := filepath.Join(dir, "overlay", filepath.FromSlash(pkg), "res", "values")
+		if err := os.MkdirAll(values, 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(filepath.Join(values, "custom-config.xml"), overlay(resources), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The class of the settings provider that loads the defaults of settings
+// into a new settings database.
+const settingsDatabaseHelper = "frameworks/base/packages/SettingsProvider/src/com/android/providers/settings/DatabaseHelper.java"
+
+const (
+	settingsDefaultsBegin = "// Begin settings defaults from the custom configuration"
+	settingsDefaultsEnd   = "// End settings defaults from the custom configuration"
+)
+
+// javaString quotes a string as a Java string literal.
+func javaString(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r > 0xffff:
+			r -= 0x10000
+			fmt.Fprintf(&b, "\\u%04x\\u%04x", 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		case r < 0x20 || r > 0x7e:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// setSettingsDefaults makes the settings provider load the defaults of
+// settings before its own, which it then leaves alone, as it only inserts
+// settings that are not there yet.  Defaults set by an earlier run are
+// replaced.
+func setSettingsDefaults(source string, settings map[string]map[string]string) (string, error) {
+	lines := strings.SplitAfter(source, "\n")
+	kept := []string{}
+	inBlock := false
+	for _, line := range lines {
+		switch strings.TrimSpace(line) {
+		case settingsDefaultsBegin:
+			inBlock = true
+			continue
+		case settingsDefaultsEnd:
+			inBlock = false
+			continue
+		}
+		if !inBlock {
+			kept = append(kept, line)
+		}
+	}
+	source = strings.Join(kept, "")
+
+	namespaces := []string{}
+	for ns := range settings {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		if len(settings[ns]) == 0 {
+			continue
+		}
+		method := settingsNamespaces[ns]
+		start := strings.Index(source, "private void "+method+"(SQLiteDatabase db) {")
+		if start < 0 {
+			return "", fmt.Errorf("there is no %s method", method)
+		}
+		compile := strings.Index(source[start:], "db.compileStatement(")
+		if compile < 0 {
+			return "", fmt.Errorf("%s compiles no statement", method)
+		}
+		compile += start
+		end := strings.Index(source[compile:], ";\n")
+		if end < 0 {
+			return "", fmt.Errorf("the statement %s compiles does not end", method)
+		}
+		end += compile + 2
+		if !strings.Contains(source[compile:end], "INSERT OR IGNORE INTO "+ns+"(") {
+			return "", fmt.Errorf("the statement %s compiles does not insert %s settings when they are not there", method, ns)
+		}
+		lineStart := strings.LastIndex(source[:compile], "\n") + 1
+		indent := source[lineStart : lineStart+len(source[lineStart:])-len(strings.TrimLeft(source[lineStart:], " \t"))]
+		block := []string{indent + settingsDefaultsBegin + "\n"}
+		for _, name := range sortedKeys(settings[ns]) {
+			block = append(block, fmt.Sprintf("%sloadSetting(stmt, %s, %s);\n", indent, javaString(name), javaString(settings[ns][name])))
+		}
+		block = append(block, indent+settingsDefaultsEnd+"\n")
+		source = source[:end] + strings.Join(block, "") + source[end:]
+	}
+	return source, nil
+}
+
+const productConfigHook = "\n# Product configuration from the custom configuration.\n-include " + productConfigTreeDir + "/custom-config.mk\n"
+
+// hookProductConfig makes the makefile of the device include the product
+// makefile of the product configuration, or no longer include it.
+func hookProductConfig(source string, hook bool) string {
+	hooked := strings.Contains(source, productConfigHook)
+	switch {
+	case hook && !hooked:
+		if source != "" && !strings.HasSuffix(source, "\n") {
+			source += "\n"
+		}
+		return source + productConfigHook
+	case !hook && hooked:
+		return strings.Replace(source, productConfigHook, "", -1)
+	}
+	return source
+}
+
+var productPackagesAssignment = regexp.MustCompile(`^\s*PRODUCT_PACKAGES\s*(\+=|:=|\?=|=)`)
+
+// removeProductPackages takes modules out of the assignments to
+// PRODUCT_PACKAGES in a makefile, and returns the modules it took out.
+// Assignments it takes nothing out of are left as they are.
+func removeProductPackages(source string, modules []string) (string, []string) {
+	remove := map[string]bool{}
+	for _, m := range modules {
+		remove[m] = true
+	}
+	lines := strings.Split(source, "\n")
+	result := []string{}
+	removed := []string{}
+	for i := 0; i < len(lines); i++ {
+		m := productPackagesAssignment.FindStringIndex(lines[i])
+		if m == nil {
+			result = append(result, lines[i])
+			continue
+		}
+		// The assignment goes on over lines ending in a backslash.
+		group := []string{lines[i]}
+		for strings.HasSuffix(strings.TrimRight(group[len(group)-1], " \t"), "\\") && i+1 < len(lines) {
+			i++
+			group = append(group, lines[i])
+		}
+		kept := []string{}
+		changed := false
+		for j, line := range group {
+			prefix, body, comment := "", strings.TrimRight(line, " \t"), ""
+			if j == 0 {
+				prefix, body = line[:m[1]]+" ", strings.TrimRight(line[m[1]:], " \t")
+			} else {
+				prefix = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			}
+			body = strings.TrimSuffix(body, "\\")
+			if k := strings.Index(body, "#"); k >= 0 {
+				body, comment = body[:k], body[k:]
+			}
+			words := []string{}
+			for _, w := range strings.Fields(body) {
+				if remove[w] {
+					removed = append(removed, w)
+					changed = true
+				} else {
+					words = append(words, w)
+				}
+			}
+			if j > 0 && len(words) == 0 && comment == "" {
+				continue
+			}
+			kept = append(kept, strings.TrimRight(prefix+strings.Join(append(words, comment), " "), " "))
+		}
+		if !changed {
+			result = append(result, group...)
+			continue
+		}
+		for j := range kept {
+			if j < len(kept)-1 {
+				kept[j] += " \\"
+			}
+		}
+		result = append(result, kept...)
+	}
+	return strings.Join(result, "\n"), removed
+}
+
+// productMakefileDirs are the directories of the tree whose makefiles add
+// packages to products.
+var productMakefileDirs = []string{"build/make/target/product", "device", "vendor"}
+
+// removeTreePackages takes modules out of PRODUCT_PACKAGES in every product
+// makefile of the tree.
+func removeTreePackages(tree string, modules []string) error {
+	found := map[string]bool{}
+	for _, dir := range productMakefileDirs {
+		err := filepath.Walk(filepath.Join(tree, dir), func(p string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() || filepath.Ext(p) != ".mk" {
+				return nil
+			}
+			return rewriteTreeFile(p, func(s string) (string, error) {
+				rewritten, removed := removeProductPackages(s, modules)
+				for _, m := range removed {
+					found[m] = true
+					rel, _ := filepath.Rel(tree, p)
+					fmt.Printf("removed   %s from PRODUCT_PACKAGES in %s\n", m, rel)
+				}
+				return rewritten, nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range modules {
+		if !found[m] {
+			fmt.Printf("warning   %s is not in PRODUCT_PACKAGES in any product makefile\n", m)
+		}
+	}
+	return nil
+}
+
+func rewriteTreeFile(path string, rewrite func(string) (string, error)) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rewritten, err := rewrite(string(contents))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if rewritten == string(contents) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, []byte(rewritten), info.Mode().Perm())
+}
+
+func productConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("product-config", flag.ExitOnError)
+	tree := flags.String("tree", "rattlesnake-os", "AOSP source tree, synced by repo")
+	makefile := flags.String("makefile", "", "product makefile of the device, relative to the tree")
+	settings := keyValueFlag{}
+	flags.Var(settings, "setting", "namespace:name=value default of a setting (may be repeated)")
+	removePackages := listFlag{}
+	flags.Var(&removePackages, "remove-package", "module to take out of PRODUCT_PACKAGES (may be repeated)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s product-config -tree <AOSP tree> -makefile <makefile> [-setting namespace:name=value...] [-remove-package module...]\n\nHooks the product configuration in %s, if there is one,\ninto the makefile of the device, sets the defaults of settings in the\nsettings provider, and takes packages out of the product makefiles.\n\n", os.Args[0], productConfigTreeDir)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *makefile == "" {
+		return fmt.Errorf("the -makefile option is mandatory")
+	}
+	defaults := map[string]map[string]string{}
+	for key, value := range settings {
+		parts := strings.SplitN(key, ":", 2)
+		if _, ok := settingsNamespaces[parts[0]]; !ok || len(parts) != 2 {
+			return fmt.Errorf("-setting %s is not in namespace:name=value form, with namespace global or secure", key)
+		}
+		if defaults[parts[0]] == nil {
+			defaults[parts[0]] = map[string]string{}
+		}
+		defaults[parts[0]][parts[1]] = value
+	}
+	_, err := os.Stat(filepath.Join(*tree, productConfigTreeDir))
+	hook := err == nil
+	if err := rewriteTreeFile(filepath.Join(*tree, *makefile), func(s string) (string, error) { return hookProductConfig(s, hook), nil }); err != nil {
+		return err
+	}
+	if len(removePackages) > 0 {
+		if err := removeTreePackages(*tree, removePackages); err != nil {
+			return err
+		}
+	}
+	// Defaults set by an earlier run are removed even if there are none
+	// now.
+	if _, err := os.Stat(filepath.Join(*tree, settingsDatabaseHelper)); os.IsNotExist(err) && len(defaults) == 0 {
+		return nil
+	}
+	return rewriteTreeFile(filepath.Join(*tree, settingsDatabaseHelper), func(s string) (string, error) { return setSettingsDefaults(s, defaults) })
+}
+
+func init() {
+	subcommands["product-config"] = productConfigCommand
+}
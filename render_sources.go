@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// sourceBundleVersion is the version of the source bundle manifest format.
+const sourceBundleVersion = 1
+
+const (
+	sourceBundleManifestFile = "manifest.json"
+	sourceBundleVersionsFile = "versions.json"
+	// sourceBundleStampFile, in the workspace, is a copy of the manifest
+	// of the last bundle imported, so that it is only imported once.
+	sourceBundleStampFile = ".source-bundle.json"
+)
+
+// sourceBundleManifest describes a source bundle: a directory with all the
+// sources and tools that a build of one configuration fetches from the
+// network, and the versions of the components it builds, so that the build
+// can run on a machine without network access.
+type sourceBundleManifest struct {
+	Version   int       `json:"version"`
+	Created   time.Time `json:"created"`
+	Device    string    `json:"device"`
+	BuildType string    `json:"build_type"`
+	// CustomConfig is the custom configuration description of the build
+	// script the bundle was made for.
+	CustomConfig string             `json:"custom_config"`
+	Items        []sourceBundleItem `json:"items"`
+}
+
+// sourceBundleItem is a tar archive of a tree, or a file, that is imported
+// into Path (relative to the workspace).
+type sourceBundleItem struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// File is the path of the item within the bundle.
+	File string `json:"file"`
+	Path string `json:"path"`
+	// Merge is set for trees whose contents are added to those already in
+	// the workspace, rather than replacing them.
+	Merge bool `json:"merge,omitempty"`
+	// URL is the repository a git mirror was made from.  Fetches from it
+	// are redirected to the mirror.
+	URL    string `json:"url,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Kinds of source bundle items.
+const (
+	sourceBundleTree = "tree"
+	sourceBundleFile = "file"
+)
+
+// sourceTrees are the parts of the workspace that a build reads sources and
+// tools from.  The AOSP checkout is carried by its .repo directory, which
+// repo sync --local-only checks out without network access.
+var sourceTrees = []struct {
+	name     string
+	path     func(buildDir string) string
+	required bool
+	merge    bool
+	// excludes are left out of the tree, relative to its root.
+	excludes []string
+}{
+	{name: "aosp", path: func(buildDir string) string { return filepath.Join(buildDir, ".repo") }, required: true},
+	{name: "chromium", path: func(string) string { return "chromium" }, excludes: []string{"./src/out"}},
+	{name: "bromite", path: func(string) string { return "bromite" }},
+	{name: "depot-tools", path: func(string) string { return "depot_tools" }},
+	{name: "vendor-in", path: func(string) string { return "vendor-in" }, merge: true},
+	{name: "chromium-cache", path: func(string) string { return "chromium-cache" }, merge: true},
+	// Gradle keeps the dependencies it downloads here.
+	{name: "gradle", path: func(string) string { return ".gradle" }, merge: true},
+}
+
+// sourceCheckouts are the git checkouts in the workspace that the build
+// script fetches anew in every build.  These are bundled as mirrors of the
+// repositories they were cloned from.
+var sourceCheckouts = []string{
+	filepath.Join("kernel", "google", "marlin"),
+}
+
+// bundledVersions are the inter-stage variables that pin the versions of the
+// components built from a source bundle.
+var bundledVersions = []string{
+	"LATEST_STACK_VERSION",
+	"STACK_UPDATE_MESSAGE",
+	"AOSP_BUILD",
+	"AOSP_BRANCH",
+	"LATEST_CHROMIUM",
+	"FDROID_CLIENT_VERSION",
+	"FDROID_PRIV_EXT_VERSION",
+}
+
+// CustomRepos returns the repositories of the custom patches, scripts,
+// prebuilts and Chromium patches, without duplicates, and leaves out local
+// custom directories.
+func (c *myStackConfig) CustomRepos() []string {
+	repos := []string{}
+	seen := map[string]bool{}
+	add := func(repo string) {
+		if _, local := c.CustomLocalDirs[repo]; repo != "" && !seen[repo] && !local {
+			repos = append(repos, repo)
+			seen[repo] = true
+		}
+	}
+	if c.CustomPatches != nil {
+		for _, r := range *c.CustomPatches {
+			add(r.Repo)
+		}
+	}
+	if c.CustomScripts != nil {
+		for _, r := range *c.CustomScripts {
+			add(r.Repo)
+		}
+	}
+	if c.CustomPrebuilts != nil {
+		for _, r := range *c.CustomPrebuilts {
+			add(r.Repo)
+		}
+	}
+	for _, r := range c.CustomChromium.Patches {
+		add(r.Repo)
+	}
+	return repos
+}
+
+var unsafeMirrorChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// mirrorName names the mirror of a repository after its URL, with a hash of
+// the URL so that URLs which only differ in punctuation do not collide.
+func mirrorName(url string) string {
+	name := strings.Trim(unsafeMirrorChars.ReplaceAllString(url, "_"), "_.")
+	if len(name) > 80 {
+		name = name[len(name)-80:]
+	}
+	sum := sha256.Sum256([]byte(url))
+	return name + "-" + hex.EncodeToString(sum[:4])
+}
+
+// archiveTree archives the contents of a directory into a tar file.
+func archiveTree(dir string, file string, excludes []string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	args := []string{"--create", "--file", file, "--directory", dir}
+	for _, x := range excludes {
+		args = append(args, "--exclude="+x)
+	}
+	return runTar(append(args, ".")...)
+}
+
+// runTar runs tar, passing its diagnostics through.
+func runTar(args ...string) error {
+	cmd := exec.Command("tar", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("tar %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func loadSourceBundleManifest(bundle string) (*sourceBundleManifest, []byte, error) {
+	path := filepath.Join(bundle, sourceBundleManifestFile)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &sourceBundleManifest{}
+	if err := json.Unmarshal(contents, m); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.Version > sourceBundleVersion {
+		return nil, nil, fmt.Errorf("%s: source bundle version %d is newer than the supported version %d", path, m.Version, sourceBundleVersion)
+	}
+	return m, contents, nil
+}
+
+// sourceExporter adds the sources of a build to a bundle.
+type sourceExporter struct {
+	config    *myStackConfig
+	workspace string
+	buildDir  string
+	bundle    string
+	items     []sourceBundleItem
+	// warnings are about what the bundle lacks that the build may need.
+	warnings []string
+}
+
+func (e *sourceExporter) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("warning: %s", msg)
+	e.warnings = append(e.warnings, msg)
+}
+
+// addTree archives a tree of the workspace.  It returns false if the tree
+// does not exist.
+func (e *sourceExporter) addTree(name string, rel string, merge bool, excludes []string) (bool, error) {
+	src := filepath.Join(e.workspace, rel)
+	if info, err := os.Stat(src); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if !info.IsDir() {
+		return false, fmt.Errorf("%s is not a directory", src)
+	}
+	file := filepath.Join("trees", name+".tar")
+	log.Printf("archiving %s", rel)
+	if err := archiveTree(src, filepath.Join(e.bundle, file), excludes); err != nil {
+		return false, err
+	}
+	e.items = append(e.items, sourceBundleItem{Name: name, Kind: sourceBundleTree, File: file, Path: rel, Merge: merge})
+	return true, nil
+}
+
+// addMirror mirrors a git repository, fetching it from its URL.
+func (e *sourceExporter) addMirror(url string) error {
+	name := mirrorName(url)
+	tmp, err := ioutil.TempDir(e.bundle, ".mirror.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	log.Printf("mirroring %s", url)
+	if err := runGit(tmp, "clone", "--mirror", url, name+".git"); err != nil {
+		return err
+	}
+	file := filepath.Join("git", name+".tar")
+	if err := archiveTree(filepath.Join(tmp, name+".git"), filepath.Join(e.bundle, file), nil); err != nil {
+		return err
+	}
+	e.items = append(e.items, sourceBundleItem{Name: "git " + url, Kind: sourceBundleTree, File: file, Path: filepath.Join("git-mirrors", name+".git"), URL: url})
+	return nil
+}
+
+// addVendorInputs bundles the factory image of the AOSP build, if the
+// configuration uses local factory images, and checks that the build will be
+// able to set up its vendor files one way or the other.
+func (e *sourceExporter) addVendorInputs(build string) error {
+	_, manifest, _ := vendorPaths(filepath.Join(e.workspace, "vendor-in"), e.config.Device, strings.ToLower(build))
+	_, err := os.Stat(manifest)
+	haveVendor := err == nil
+	if e.config.FactoryImagesDir != "" {
+		image, err := findFactoryImage(e.config.FactoryImagesDir, e.config.Device, build)
+		if err != nil && !haveVendor {
+			return err
+		}
+		if err == nil {
+			file := filepath.Join("files", filepath.Base(image))
+			log.Printf("copying %s", image)
+			if err := copyFile(image, filepath.Join(e.bundle, file)); err != nil {
+				return err
+			}
+			e.items = append(e.items, sourceBundleItem{Name: "factory image", Kind: sourceBundleFile, File: file, Path: filepath.Join("factory-images", filepath.Base(image))})
+			return nil
+		}
+	}
+	if !haveVendor {
+		e.warnf("there are no extracted vendor files or factory image for %s %s; the offline build will not be able to set up vendor files", e.config.Device, build)
+	}
+	return nil
+}
+
+func (e *sourceExporter) export(jobs int) (*sourceBundleManifest, error) {
+	saved, from, err := latestInterstage(filepath.Join(e.workspace, "s3", "interstage"))
+	if err != nil {
+		return nil, err
+	}
+	if saved == nil {
+		return nil, fmt.Errorf("no version check has been recorded in %s; run the build script with network access first", e.workspace)
+	}
+	versions := &interstageVariables{Version: interstageVersion, Strings: map[string]string{}, Lists: map[string][]string{}}
+	for _, name := range bundledVersions {
+		versions.Strings[name] = saved.Strings[name]
+	}
+	build := versions.Strings["AOSP_BUILD"]
+	if build == "" || versions.Strings["LATEST_CHROMIUM"] == "" {
+		return nil, fmt.Errorf("%s does not record the AOSP and Chromium versions", from)
+	}
+	log.Printf("bundling the sources of AOSP %s and Chromium %s for %s, as chosen by %s", build, versions.Strings["LATEST_CHROMIUM"], e.config.Device, from)
+
+	for _, t := range sourceTrees {
+		found, err := e.addTree(t.name, t.path(e.buildDir), t.merge, t.excludes)
+		if err != nil {
+			return nil, err
+		}
+		if !found && t.required {
+			return nil, fmt.Errorf("%s is missing; run the build script with network access first", filepath.Join(e.workspace, t.path(e.buildDir)))
+		}
+	}
+	if !e.has("chromium") && !e.has("chromium-cache") {
+		e.warnf("there is neither a Chromium checkout nor a Chromium cache; the offline build will not be able to build Chromium")
+	}
+	if err := e.addVendorInputs(build); err != nil {
+		return nil, err
+	}
+	repos := []string{}
+	for _, repo := range e.config.CustomRepos() {
+		repos = append(repos, e.config.repoURL(repo))
+	}
+	for _, checkout := range sourceCheckouts {
+		if _, err := os.Stat(filepath.Join(e.workspace, checkout, ".git")); err != nil {
+			continue
+		}
+		out, err := exec.Command("git", "-C", filepath.Join(e.workspace, checkout), "config", "--get", "remote.origin.url").Output()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find the origin of %s: %v", checkout, err)
+		}
+		repos = append(repos, strings.TrimSpace(string(out)))
+	}
+	mirrored := map[string]bool{}
+	for _, repo := range repos {
+		if mirrored[repo] {
+			continue
+		}
+		if err := e.addMirror(repo); err != nil {
+			return nil, err
+		}
+		mirrored[repo] = true
+	}
+
+	err = parallel(len(e.items), jobs, func(i int) error {
+		var err error
+		e.items[i].SHA256, e.items[i].Size, err = hashFile(filepath.Join(e.bundle, e.items[i].File))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	contents, err := json.MarshalIndent(versions, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomically(filepath.Join(e.bundle, sourceBundleVersionsFile), append(contents, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	m := &sourceBundleManifest{
+		Version:      sourceBundleVersion,
+		Created:      time.Now().UTC(),
+		Device:       e.config.Device,
+		BuildType:    e.config.BuildType,
+		CustomConfig: e.config.CustomConfigDescription(),
+		Items:        e.items,
+	}
+	contents, err = json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return m, writeFileAtomically(filepath.Join(e.bundle, sourceBundleManifestFile), append(contents, '\n'), 0644)
+}
+
+func (e *sourceExporter) has(name string) bool {
+	for _, item := range e.items {
+		if item.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func exportSourcesCommand(args []string) error {
+	flags := flag.NewFlagSet("export-sources", flag.ExitOnError)
+	workspace := flags.String("workspace", ".", "directory the build script runs in (the one containing s3/)")
+	buildDir := flags.String("build-dir", "rattlesnake-os", "AOSP source tree, relative to the workspace")
+	bundle := flags.String("bundle", "", "directory to create the source bundle in; it must not exist or be empty")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of files to hash in parallel")
+	// The build configuration is described with the same options used to
+	// render the build script.
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if f.Name != "output" {
+			flags.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s export-sources -bundle <directory> [options]\n\nPackages the sources a build of this configuration needs, as fetched by\nthe last build in the workspace, so that it can run without network access.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *bundle == "" {
+		return fmt.Errorf("the -bundle option is mandatory")
+	}
+
+	// The configuration is loaded as if the build script were rendered
+	// elsewhere, so that nothing in the workspace is touched.
+	tmp, err := ioutil.TempDir("", "export-sources.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	*output = filepath.Join(tmp, filepath.Base(*output))
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	e := &sourceExporter{config: config, buildDir: *buildDir}
+	if e.workspace, err = filepath.Abs(*workspace); err != nil {
+		return err
+	}
+	if e.bundle, err = filepath.Abs(*bundle); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(e.bundle); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", e.bundle)
+	}
+	if err := os.MkdirAll(e.bundle, 0755); err != nil {
+		return err
+	}
+	m, err := e.export(*jobs)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, item := range m.Items {
+		fmt.Printf("%12d  %s  (%s)\n", item.Size, item.File, item.Name)
+		total += item.Size
+	}
+	fmt.Printf("%d bytes in %s.\n", total, e.bundle)
+	for _, w := range e.warnings {
+		fmt.Printf("Warning: %s.\n", w)
+	}
+	return nil
+}
+
+// importItem puts an item of the bundle in its place in the workspace.
+func importItem(bundle string, workspace string, item sourceBundleItem) error {
+	src := filepath.Join(bundle, item.File)
+	dst := filepath.Join(workspace, item.Path)
+	log.Printf("importing %s into %s", item.Name, item.Path)
+	switch item.Kind {
+	case sourceBundleFile:
+		return copyFile(src, dst)
+	case sourceBundleTree:
+		if !item.Merge {
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		if err := runTar("--extract", "--file", src, "--directory", dst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: unknown kind of item %q", item.Name, item.Kind)
+	}
+	if item.URL == "" {
+		return nil
+	}
+	// The build script runs with the workspace as its home directory, so
+	// this is the global git configuration of the build.
+	gitconfig := filepath.Join(workspace, ".gitconfig")
+	return runGit(workspace, "config", "--file", gitconfig, "--replace-all", "url."+dst+".insteadOf", item.URL)
+}
+
+// importSources verifies a bundle and imports it into the workspace, unless
+// it was the last one imported.
+func importSources(bundle string, workspace string, jobs int, w io.Writer) error {
+	m, contents, err := loadSourceBundleManifest(bundle)
+	if err != nil {
+		return err
+	}
+	stamp := filepath.Join(workspace, sourceBundleStampFile)
+	if imported, err := ioutil.ReadFile(stamp); err == nil && bytes.Equal(imported, contents) {
+		fmt.Fprintf(w, "Source bundle %s (made %s) is already imported.\n", bundle, m.Created.Local().Format(time.RFC1123))
+		return nil
+	}
+
+	problems := make([]string, len(m.Items))
+	err = parallel(len(m.Items), jobs, func(i int) error {
+		sum, _, err := hashFile(filepath.Join(bundle, m.Items[i].File))
+		if err != nil {
+			return err
+		}
+		if sum != m.Items[i].SHA256 {
+			problems[i] = fmt.Sprintf("%s has sha256 %s instead of %s", m.Items[i].File, sum, m.Items[i].SHA256)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	damaged := false
+	for _, p := range problems {
+		if p != "" {
+			log.Printf("%s", p)
+			damaged = true
+		}
+	}
+	if damaged {
+		return fmt.Errorf("source bundle %s does not match its manifest", bundle)
+	}
+
+	// A partially imported bundle must be imported again.
+	if err := os.Remove(stamp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, item := range m.Items {
+		if err := importItem(bundle, workspace, item); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomically(stamp, contents, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Imported source bundle %s (made %s for %s).\n", bundle, m.Created.Local().Format(time.RFC1123), m.Device)
+	return nil
+}
+
+func importSourcesCommand(args []string) error {
+	flags := flag.NewFlagSet("import-sources", flag.ExitOnError)
+	bundle := flags.String("bundle", "", "directory of the source bundle")
+	workspace := flags.String("workspace", ".", "directory the build script runs in (the one containing s3/)")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of files to hash in parallel")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import-sources -bundle <directory> [options]\n\nVerifies a source bundle made by export-sources, and puts its sources in\nplace in the workspace.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *bundle == "" {
+		return fmt.Errorf("the -bundle option is mandatory")
+	}
+	ws, err := filepath.Abs(*workspace)
+	if err != nil {
+		return err
+	}
+	b, err := filepath.Abs(*bundle)
+	if err != nil {
+		return err
+	}
+	return importSources(b, ws, *jobs, os.Stdout)
+}
+
+func init() {
+	subcommands["export-sources"] = exportSourcesCommand
+	subcommands["import-sources"] = importSourcesCommand
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildStateVersion is the version of the build state file format that
+// this program reads and writes.
+const buildStateVersion = 1
+
+// buildState is the record of successful builds, kept by the build script
+// in build-state.json within the release bucket.  It replaces the loose
+// text files that used to live under build-environment/.
+type buildState struct {
+	Version int           `json:"version"`
+	Builds  []buildRecord `json:"builds"`
+}
+
+// buildRecord describes one successful build.
+type buildRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Inputs are the settings the build was made with: device, build
+	// type, custom configuration and stack version.
+	Inputs map[string]string `json:"inputs"`
+	// Versions are the versions of the components that went into the build.
+	Versions  map[string]string `json:"versions"`
+	Artifacts []artifactRecord  `json:"artifacts"`
+	// Migrated is set on the record created from the old text files.
+	Migrated bool `json:"migrated,omitempty"`
+}
+
+type artifactRecord struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func loadBuildState(path string) (*buildState, error) {
+	state := &buildState{Version: buildStateVersion, Builds: []buildRecord{}}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if state.Version > buildStateVersion {
+		return nil, fmt.Errorf("%s: build state version %d is newer than the supported version %d", path, state.Version, buildStateVersion)
+	}
+	state.Version = buildStateVersion
+	return state, nil
+}
+
+// writeFileAtomically replaces path with contents, so that an interrupted
+// write never leaves a truncated file behind.
+func writeFileAtomically(path string, contents []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *buildState) save(path string) error {
+	contents, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, append(contents, '\n'), 0644)
+}
+
+// latest returns the most recent successful build, or nil if none exists.
+func (s *buildState) latest() *buildRecord {
+	if len(s.Builds) == 0 {
+		return nil
+	}
+	return &s.Builds[len(s.Builds)-1]
+}
+
+// get looks up a dotted key, such as inputs.device or versions.chromium,
+// in the most recent successful build.
+func (s *buildState) get(key string) (string, bool) {
+	b := s.latest()
+	if b == nil {
+		return "", false
+	}
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		if key == "timestamp" {
+			return b.Timestamp.UTC().Format(time.RFC3339), true
+		}
+		return "", false
+	}
+	var m map[string]string
+	switch parts[0] {
+	case "inputs":
+		m = b.Inputs
+	case "versions":
+		m = b.Versions
+	case "artifacts":
+		for _, a := range b.Artifacts {
+			if a.Path == parts[1] || filepath.Base(a.Path) == parts[1] {
+				return a.SHA256, true
+			}
+		}
+		return "", false
+	}
+	v, ok := m[parts[1]]
+	return v, ok
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// keyValueFlag collects repeated -flag key=value options.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	return fmt.Sprintf("%v", map[string]string(f))
+}
+
+func (f keyValueFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not in key=value form", s)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// listFlag collects repeated options.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// readLines returns the non-empty lines of a file.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func stateRecord(path string, args []string) error {
+	flags := flag.NewFlagSet("state record", flag.ExitOnError)
+	inputs := keyValueFlag{}
+	versions := keyValueFlag{}
+	artifacts := listFlag{}
+	flags.Var(inputs, "input", "key=value input of the build (repeatable)")
+	flags.Var(versions, "version", "key=value version of a component of the build (repeatable)")
+	flags.Var(&artifacts, "artifact", "path to an artifact of the build (repeatable)")
+	artifactList := flags.String("artifact-list", "", "file listing paths to artifacts of the build, one per line")
+	keep := flags.Int("keep", 50, "number of builds to keep in the state")
+	flags.Parse(args)
+
+	if *artifactList != "" {
+		listed, err := readLines(*artifactList)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		artifacts = append(artifacts, listed...)
+	}
+
+	record := buildRecord{
+		Timestamp: time.Now().UTC(),
+		Inputs:    inputs,
+		Versions:  versions,
+		Artifacts: []artifactRecord{},
+	}
+	seen := map[string]bool{}
+	for _, a := range artifacts {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		sum, size, err := hashFile(a)
+		if os.IsNotExist(err) {
+			// Artifacts superseded later in the build are gone by now.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		record.Artifacts = append(record.Artifacts, artifactRecord{Path: a, Size: size, SHA256: sum})
+	}
+
+	state, err := loadBuildState(path)
+	if err != nil {
+		return err
+	}
+	state.Builds = append(state.Builds, record)
+	if *keep > 0 && len(state.Builds) > *keep {
+		state.Builds = state.Builds[len(state.Builds)-*keep:]
+	}
+	return state.save(path)
+}
+
+func stateGet(path string, args []string) error {
+	flags := flag.NewFlagSet("state get", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("state get takes exactly one key")
+	}
+	state, err := loadBuildState(path)
+	if err != nil {
+		return err
+	}
+	// Like reading a missing file from S3, an unknown key yields nothing.
+	if v, ok := state.get(flags.Arg(0)); ok {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+func stateShow(path string, args []string) error {
+	flags := flag.NewFlagSet("state show", flag.ExitOnError)
+	format := flags.String("format", "text", "output format (text or json)")
+	flags.Parse(args)
+	state, err := loadBuildState(path)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		out, err := json.MarshalIndent(state, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", out)
+		return nil
+	}
+	if *format != "text" {
+		return fmt.Errorf("unknown format %q (must be text or json)", *format)
+	}
+	if len(state.Builds) == 0 {
+		fmt.Println("No successful builds recorded.")
+	}
+	for _, b := range state.Builds {
+		fmt.Printf("Build of %s:\n", b.Timestamp.Local().Format(time.RFC1123))
+		for _, section := range []struct {
+			name string
+			m    map[string]string
+		}{{"input", b.Inputs}, {"version", b.Versions}} {
+			keys := []string{}
+			for k := range section.m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("  %s %s: %s\n", section.name, k, strings.Replace(section.m[k], "\n", "\n    ", -1))
+			}
+		}
+		for _, a := range b.Artifacts {
+			fmt.Printf("  artifact %s (%d bytes): sha256 %s\n", a.Path, a.Size, a.SHA256)
+		}
+	}
+	return nil
+}
+
+// legacyBuildState reads the text files that older versions of the build
+// script left in the release bucket.  It returns nil if there are none.
+func legacyBuildState(bucket string) (*buildState, error) {
+	record := buildRecord{
+		Inputs:    map[string]string{},
+		Versions:  map[string]string{},
+		Artifacts: []artifactRecord{},
+		Migrated:  true,
+	}
+	found := false
+	for key, p := range map[string]string{
+		"device":        filepath.Join(bucket, "build-environment", "device"),
+		"build_type":    filepath.Join(bucket, "build-environment", "build-type"),
+		"custom_config": filepath.Join(bucket, "build-environment", "custom-config"),
+		"stack_version": filepath.Join(bucket, "rattlesnakeos-stack", "revision"),
+	} {
+		v, ok, err := readStateFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		found = true
+		record.Inputs[key] = v
+		if info, err := os.Stat(p); err == nil && info.ModTime().After(record.Timestamp) {
+			record.Timestamp = info.ModTime().UTC()
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return &buildState{Version: buildStateVersion, Builds: []buildRecord{record}}, nil
+}
+
+// stateMigrate creates the build state from the files of older versions of
+// the build script, so that upgrading does not cause a rebuild.
+func stateMigrate(path string, args []string) error {
+	flags := flag.NewFlagSet("state migrate", flag.ExitOnError)
+	bucket := flags.String("bucket", filepath.Dir(path), "release bucket directory holding the old build-environment files")
+	flags.Parse(args)
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return err
+	}
+	state, err := legacyBuildState(*bucket)
+	if err != nil || state == nil {
+		return err
+	}
+	return state.save(path)
+}
+
+func stateCommand(args []string) error {
+	flags := flag.NewFlagSet("state", flag.ExitOnError)
+	file := flags.String("file", "build-state.json", "path to the build state file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s state [-file build-state.json] <record|get|show|migrate> [options]\n\nManages the record of successful builds.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "record":
+		return stateRecord(*file, rest)
+	case "get":
+		return stateGet(*file, rest)
+	case "show":
+		return stateShow(*file, rest)
+	case "migrate":
+		return stateMigrate(*file, rest)
+	}
+	return fmt.Errorf("unknown state subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["state"] = stateCommand
+}
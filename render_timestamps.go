@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// timestampIndexVersion is the version of the timestamp index file format.
+const timestampIndexVersion = 1
+
+// Kinds of entries in a timestamp index.
+const (
+	timestampFile    = "file"
+	timestampOther   = "other"
+	timestampDeleted = "deleted"
+)
+
+// timestampIndex records the contents and modification times of files, so
+// that files which come back with the same contents after a source tree is
+// cleaned (or synced) get their old modification times back, and the build
+// system does not consider them (and everything depending on them) stale.
+type timestampIndex struct {
+	Version int              `json:"version"`
+	Entries []timestampEntry `json:"entries"`
+}
+
+type timestampEntry struct {
+	// Path is relative to the tree the index was made for.  Names that
+	// are not valid UTF-8 cannot be represented in a JSON string, so
+	// these are kept in RawPath instead.
+	Path    string `json:"path,omitempty"`
+	RawPath []byte `json:"raw_path,omitempty"`
+	Kind    string `json:"kind"`
+	SHA256  string `json:"sha256,omitempty"`
+	// MTime is in nanoseconds since the epoch.
+	MTime int64 `json:"mtime,omitempty"`
+}
+
+func (e timestampEntry) name() string {
+	if e.RawPath != nil {
+		return string(e.RawPath)
+	}
+	return e.Path
+}
+
+// newTimestampEntry records the file at name, relative to dir.
+func newTimestampEntry(dir string, name string) (timestampEntry, error) {
+	e := timestampEntry{Path: name}
+	if !utf8.ValidString(name) {
+		e = timestampEntry{RawPath: []byte(name)}
+	}
+	p := filepath.Join(dir, name)
+	info, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		e.Kind = timestampDeleted
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+	e.MTime = info.ModTime().UnixNano()
+	if !info.Mode().IsRegular() {
+		// Directories, symbolic links and the like are recorded, but
+		// their modification times are never restored.
+		e.Kind = timestampOther
+		return e, nil
+	}
+	e.Kind = timestampFile
+	e.SHA256, _, err = hashFile(p)
+	return e, err
+}
+
+// parallel calls fn for every number from 0 to n-1, using up to jobs
+// goroutines, and returns the first error fn returned.
+func parallel(n int, jobs int, fn func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	work := make(chan int)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := fn(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// indexFiles records the given files, relative to dir.
+func indexFiles(dir string, names []string, jobs int) (*timestampIndex, error) {
+	index := &timestampIndex{Version: timestampIndexVersion, Entries: make([]timestampEntry, len(names))}
+	err := parallel(len(names), jobs, func(i int) error {
+		e, err := newTimestampEntry(dir, names[i])
+		index.Entries[i] = e
+		return err
+	})
+	return index, err
+}
+
+func (index *timestampIndex) save(path string) error {
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, append(contents, '\n'), 0644)
+}
+
+func loadTimestampIndex(path string) (*timestampIndex, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &timestampIndex{}
+	if err := json.Unmarshal(contents, index); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if index.Version > timestampIndexVersion {
+		return nil, fmt.Errorf("%s: timestamp index version %d is newer than the supported version %d", path, index.Version, timestampIndexVersion)
+	}
+	return index, nil
+}
+
+// restoreResult counts what happened to the entries of an index.
+type restoreResult struct {
+	restored, changed, kept, skipped int
+}
+
+func (r restoreResult) String() string {
+	return fmt.Sprintf("%d restored, %d changed, %d kept their time stamp, %d missing or not files", r.restored, r.changed, r.kept, r.skipped)
+}
+
+// restore sets back the modification time of every file in the index that
+// still has the contents it had when the index was made.  Files that have
+// changed have earned their new modification time.
+func (index *timestampIndex) restore(dir string, jobs int, verbose bool) (restoreResult, error) {
+	var mu sync.Mutex
+	result := restoreResult{}
+	count := func(n *int, name string, why string) {
+		mu.Lock()
+		defer mu.Unlock()
+		*n++
+		if verbose {
+			log.Printf("%s: time restore: %s %s", dir, name, why)
+		}
+	}
+	err := parallel(len(index.Entries), jobs, func(i int) error {
+		e := index.Entries[i]
+		name := e.name()
+		if e.Kind != timestampFile {
+			count(&result.skipped, name, "was not a file")
+			return nil
+		}
+		p := filepath.Join(dir, name)
+		info, err := os.Lstat(p)
+		if err != nil || !info.Mode().IsRegular() {
+			count(&result.skipped, name, "does not exist")
+			return nil
+		}
+		if info.ModTime().UnixNano() == e.MTime {
+			count(&result.kept, name, "has kept its time stamp")
+			return nil
+		}
+		sum, _, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		if sum != e.SHA256 {
+			count(&result.changed, name, "sum differs")
+			return nil
+		}
+		mtime := time.Unix(0, e.MTime)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			return err
+		}
+		count(&result.restored, name, "unchanged, mtime differs, restoring")
+		return nil
+	})
+	return result, err
+}
+
+// findGitCheckouts returns every directory under root that has a .git
+// directory, including nested checkouts.
+func findGitCheckouts(root string) ([]string, error) {
+	checkouts := []string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			checkouts = append(checkouts, filepath.Dir(p))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(checkouts)
+	return checkouts, err
+}
+
+// gitStatusPaths returns the paths of all files in a git checkout that are
+// modified, untracked or ignored.  Untracked and ignored directories are
+// returned as a whole, like git status does.
+func gitStatusPaths(dir string) ([]string, error) {
+	cmd := exec.Command("git", "status", "--ignored", "--porcelain", "-z")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status: %v", err)
+	}
+	paths := []string{}
+	records := bytes.Split(out, []byte{0})
+	for i := 0; i < len(records); i++ {
+		r := string(records[i])
+		if len(r) < 4 {
+			continue
+		}
+		paths = append(paths, strings.TrimSuffix(r[3:], "/"))
+		if r[0] == 'R' || r[0] == 'C' {
+			// Renames and copies are followed by the original path.
+			i++
+		}
+	}
+	return paths, nil
+}
+
+func runGit(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// checkoutIndexPath is where the index of a git checkout is kept, out of
+// the reach of git clean.
+func checkoutIndexPath(checkout string) string {
+	return filepath.Join(checkout, ".git", "timestamps.json")
+}
+
+// timestampsClean records every modified, untracked or ignored file of every
+// git checkout under the root, then cleans and resets the checkouts.
+func timestampsClean(root string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("timestamps clean", flag.ExitOnError)
+	flags.Parse(args)
+
+	checkouts, err := findGitCheckouts(root)
+	if err != nil {
+		return err
+	}
+	return parallel(len(checkouts), jobs, func(i int) error {
+		checkout := checkouts[i]
+		paths, err := gitStatusPaths(checkout)
+		if err != nil {
+			return fmt.Errorf("%s: %v", checkout, err)
+		}
+		indexPath := checkoutIndexPath(checkout)
+		if len(paths) == 0 {
+			log.Printf("%s: does not have modifications", checkout)
+			if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		log.Printf("%s: has modifications (%d paths)", checkout, len(paths))
+		// Checkouts are processed in parallel already.
+		index, err := indexFiles(checkout, paths, 1)
+		if err != nil {
+			return fmt.Errorf("%s: %v", checkout, err)
+		}
+		if err := index.save(indexPath); err != nil {
+			return err
+		}
+		if err := runGit(checkout, "clean", "-fxd"); err != nil {
+			return fmt.Errorf("%s: %v", checkout, err)
+		}
+		if err := runGit(checkout, "reset", "--hard"); err != nil {
+			return fmt.Errorf("%s: %v", checkout, err)
+		}
+		return nil
+	})
+}
+
+// timestampsSave records every file under the root.
+func timestampsSave(root string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("timestamps save", flag.ExitOnError)
+	indexPath := flags.String("index", filepath.Join(root, ".timestamps.json"), "path to the index to write")
+	flags.Parse(args)
+
+	absIndex, err := filepath.Abs(*indexPath)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, err := filepath.Abs(p); err != nil || abs == absIndex || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	index, err := indexFiles(root, names, jobs)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: recorded %d paths", root, len(names))
+	return index.save(*indexPath)
+}
+
+// timestampsRestore restores modification times from the given index, or
+// from the indexes that timestampsClean left in the git checkouts under
+// the root.
+func timestampsRestore(root string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("timestamps restore", flag.ExitOnError)
+	indexPath := flags.String("index", "", "path to the index to restore from (default the indexes of all git checkouts under the tree)")
+	verbose := flags.Bool("v", false, "report what happens to every file")
+	flags.Parse(args)
+
+	restoreFrom := func(dir string, path string, jobs int) error {
+		index, err := loadTimestampIndex(path)
+		if os.IsNotExist(err) {
+			if *verbose {
+				log.Printf("%s: time restore: nothing to restore", dir)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		result, err := index.restore(dir, jobs, *verbose)
+		if err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+		log.Printf("%s: time restore: %s", dir, result)
+		return nil
+	}
+
+	if *indexPath != "" {
+		return restoreFrom(root, *indexPath, jobs)
+	}
+	checkouts, err := findGitCheckouts(root)
+	if err != nil {
+		return err
+	}
+	return parallel(len(checkouts), jobs, func(i int) error {
+		return restoreFrom(checkouts[i], checkoutIndexPath(checkouts[i]), 1)
+	})
+}
+
+func timestampsCommand(args []string) error {
+	flags := flag.NewFlagSet("timestamps", flag.ExitOnError)
+	root := flags.String("root", ".", "tree to operate on")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of files or checkouts to process in parallel")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s timestamps [-root dir] <save|restore|clean> [options]\n\nPreserves the modification times of files whose contents do not change across cleans and syncs.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "save":
+		return timestampsSave(*root, *jobs, rest)
+	case "restore":
+		return timestampsRestore(*root, *jobs, rest)
+	case "clean":
+		return timestampsClean(*root, *jobs, rest)
+	}
+	return fmt.Errorf("unknown timestamps subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["timestamps"] = timestampsCommand
+}
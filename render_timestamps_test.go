@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func writeFile(t *testing.T, path string, contents string, mtime time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func mtimeOf(t *testing.T, path string) time.Time {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ModTime()
+}
+
+// A build modifies a tracked file and leaves untracked outputs behind.  After
+// a clean, the next build makes some of them again with the same contents,
+// changes one and does not make another one at all.  Only the files that
+// came back unchanged get their old modification times back.
+func TestTimestampsCleanRestore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root, err := ioutil.TempDir("", "timestamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	checkout := filepath.Join(root, "project")
+	if err := os.Mkdir(checkout, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git(t, checkout, "init", "-q")
+	writeFile(t, filepath.Join(checkout, "tracked"), "original\n", time.Time{})
+	git(t, checkout, "add", "tracked")
+	git(t, checkout, "commit", "-q", "-m", "initial")
+
+	old := time.Unix(1500000000, 0)
+	odd := "odd\nname\xff"
+	writeFile(t, filepath.Join(checkout, "tracked"), "modified\n", old)
+	writeFile(t, filepath.Join(checkout, "unchanged"), "same\n", old)
+	writeFile(t, filepath.Join(checkout, "modified"), "before\n", old)
+	writeFile(t, filepath.Join(checkout, "deleted"), "gone\n", old)
+	writeFile(t, filepath.Join(checkout, odd), "odd\n", old)
+
+	if err := timestampsClean(root, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"unchanged", "modified", "deleted", odd} {
+		if _, err := os.Lstat(filepath.Join(checkout, name)); !os.IsNotExist(err) {
+			t.Fatalf("%q is still there after clean: %v", name, err)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(checkout, "tracked")); string(contents) != "original\n" {
+		t.Fatalf("tracked file was not reset by clean: %q", contents)
+	}
+
+	writeFile(t, filepath.Join(checkout, "tracked"), "modified\n", time.Time{})
+	writeFile(t, filepath.Join(checkout, "unchanged"), "same\n", time.Time{})
+	writeFile(t, filepath.Join(checkout, "modified"), "after\n", time.Time{})
+	writeFile(t, filepath.Join(checkout, odd), "odd\n", time.Time{})
+
+	if err := timestampsRestore(root, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tracked", "unchanged", odd} {
+		if got := mtimeOf(t, filepath.Join(checkout, name)); !got.Equal(old) {
+			t.Errorf("%q has modification time %v, not the restored %v", name, got, old)
+		}
+	}
+	if got := mtimeOf(t, filepath.Join(checkout, "modified")); got.Equal(old) {
+		t.Errorf("modified file got its old modification time back")
+	}
+	if _, err := os.Lstat(filepath.Join(checkout, "deleted")); !os.IsNotExist(err) {
+		t.Errorf("restore brought back a deleted file: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// gitWithIndex runs git in a checkout with another index file than its
+// own, which is left alone, and returns what git writes to its output.
+func gitWithIndex(dir string, index string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+index)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s in %s: %v: %s", strings.Join(args, " "), dir, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// snapshotIndex is where the snapshot of a project is kept.
+func snapshotIndex(dir string, project string) string {
+	return filepath.Join(dir, url.PathEscape(project)+".index")
+}
+
+// treeSnapshot records the state of every project in a tree synced by repo
+// in an index file of its own, starting from a copy of the project's index
+// so that unchanged files need not be hashed again.
+func treeSnapshot(tree string, dir string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("tree-diff snapshot", flag.ExitOnError)
+	flags.Parse(args)
+	projects, err := readLines(filepath.Join(tree, ".repo", "project.list"))
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return parallel(len(projects), jobs, func(i int) error {
+		checkout := filepath.Join(tree, projects[i])
+		out, err := exec.Command("git", "-C", checkout, "rev-parse", "--git-path", "index").Output()
+		if err != nil {
+			// Projects that are not checked out cannot change.
+			return nil
+		}
+		index := strings.TrimSpace(string(out))
+		if !filepath.IsAbs(index) {
+			index = filepath.Join(checkout, index)
+		}
+		snapshot := snapshotIndex(dir, projects[i])
+		if err := copyFile(index, snapshot); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		_, err = gitWithIndex(checkout, snapshot, "add", "--all", "--", ".")
+		return err
+	})
+}
+
+// treeDiff writes the changes to a tree since its snapshot, as a patch that
+// applies to the top of the tree with patch -p1.
+func treeDiff(tree string, dir string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("tree-diff diff", flag.ExitOnError)
+	output := flags.String("output", "", "file to write the changes to")
+	flags.Parse(args)
+	if *output == "" {
+		return fmt.Errorf("the -output option is mandatory")
+	}
+	projects, err := readLines(filepath.Join(tree, ".repo", "project.list"))
+	if err != nil {
+		return err
+	}
+	diffs := make([][]byte, len(projects))
+	err = parallel(len(projects), jobs, func(i int) error {
+		snapshot := snapshotIndex(dir, projects[i])
+		if _, err := os.Stat(snapshot); os.IsNotExist(err) {
+			return nil
+		}
+		checkout := filepath.Join(tree, projects[i])
+		// New files are added with intent to add, so that they show in
+		// the changes to the snapshot.
+		if _, err := gitWithIndex(checkout, snapshot, "add", "--intent-to-add", "--", "."); err != nil {
+			return err
+		}
+		diffs[i], err = gitWithIndex(checkout, snapshot, "diff", "--binary", "--src-prefix=a/"+projects[i]+"/", "--dst-prefix=b/"+projects[i]+"/")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	changed := []string{}
+	patch := []byte{}
+	for i := range projects {
+		if len(diffs[i]) > 0 {
+			changed = append(changed, projects[i])
+			patch = append(patch, diffs[i]...)
+		}
+	}
+	if err := writeFileAtomically(*output, patch, 0644); err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		log.Printf("no changes to %s", tree)
+	} else {
+		log.Printf("changes to %d projects of %s (%s) written to %s", len(changed), tree, strings.Join(changed, ", "), *output)
+	}
+	return nil
+}
+
+func treeDiffCommand(args []string) error {
+	flags := flag.NewFlagSet("tree-diff", flag.ExitOnError)
+	tree := flags.String("tree", "rattlesnake-os", "AOSP source tree, synced by repo")
+	dir := flags.String("dir", "", "directory to keep the snapshot of the tree in")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of projects to examine in parallel")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s tree-diff -dir <directory> [options] <snapshot|diff -output <file>>\n\nRecords the changes made to the projects of a tree synced by repo, such\nas by a custom script, since a snapshot of the tree.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *dir == "" {
+		return fmt.Errorf("the -dir option is mandatory")
+	}
+	// git runs in the projects, and takes the snapshot relative to them.
+	snapshots, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "snapshot":
+		return treeSnapshot(*tree, snapshots, *jobs, rest)
+	case "diff":
+		return treeDiff(*tree, snapshots, *jobs, rest)
+	}
+	return fmt.Errorf("unknown tree-diff subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["tree-diff"] = treeDiffCommand
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseChannels are the channels a build may be released to, as those of
+// CopperheadOS.  The Updater of a build looks for updates in the file of its
+// channel, <device>-<channel>, at the release download address.
+var releaseChannels = []string{"stable", "beta", "dev", "canary"}
+
+// updaterNetworks are the network constraints the Updater may download
+// updates under, by the JobInfo constant (and its value) of each.
+var updaterNetworks = map[string][2]string{
+	"any":         {"NETWORK_TYPE_ANY", "1"},
+	"unmetered":   {"NETWORK_TYPE_UNMETERED", "2"},
+	"not-roaming": {"NETWORK_TYPE_NOT_ROAMING", "3"},
+}
+
+// The Updater does not check more often than JobScheduler runs periodic jobs.
+const minUpdaterCheckInterval = 15 * time.Minute
+
+// The Updater checks the channel of this property, if it is set, rather than
+// the one chosen in its settings.
+const updaterChannelProperty = "sys.update.channel"
+
+// updaterConfig is what the build changes about the Updater.  Zero values
+// leave the defaults of the Updater alone.
+type updaterConfig struct {
+	// Channel is the release channel, which builds are published to and
+	// the Updater checks, through updaterChannelProperty, unless it is
+	// stable.
+	Channel       string
+	CheckInterval time.Duration
+	Network       string
+	// AutoInstall is "true" or "false" to make the Updater finish
+	// installing updates by itself (rebooting into them when the device is
+	// idle) or leave that to the user.
+	AutoInstall string
+}
+
+func newUpdaterConfig(channel string, interval time.Duration, network string, autoInstall string) (*updaterConfig, error) {
+	known := false
+	for _, c := range releaseChannels {
+		if c == channel {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("-release-channel must be one of %s, not %q", strings.Join(releaseChannels, ", "), channel)
+	}
+	if interval != 0 && interval < minUpdaterCheckInterval {
+		return nil, fmt.Errorf("-updater-check-interval must be at least %s, not %s", minUpdaterCheckInterval, interval)
+	}
+	if _, ok := updaterNetworks[network]; network != "" && !ok {
+		return nil, fmt.Errorf("-updater-network must be any, unmetered or not-roaming, not %q", network)
+	}
+	if autoInstall != "" {
+		b, err := strconv.ParseBool(autoInstall)
+		if err != nil {
+			return nil, fmt.Errorf("-updater-auto-install must be true or false, not %q", autoInstall)
+		}
+		autoInstall = strconv.FormatBool(b)
+	}
+	return &updaterConfig{channel, interval, network, autoInstall}, nil
+}
+
+// changesUpdater tells whether the sources of the Updater need changes.
+// The channel is a property of the product instead.
+func (u *updaterConfig) changesUpdater() bool {
+	return u.CheckInterval != 0 || u.Network != "" || u.AutoInstall != ""
+}
+
+// Identity is what the rebuild check compares to tell a change of the
+// release channel or the Updater settings.  It is the bare channel name for
+// an Updater left as it is.
+func (u *updaterConfig) Identity() string {
+	s := u.Channel
+	if u.CheckInterval != 0 {
+		s += " check-interval=" + u.CheckInterval.String()
+	}
+	if u.Network != "" {
+		s += " network=" + u.Network
+	}
+	if u.AutoInstall != "" {
+		s += " auto-install=" + u.AutoInstall
+	}
+	return s
+}
+
+// Args are the options of the updater-config subcommand that make these
+// changes, or empty if the Updater is left as it is.
+func (u *updaterConfig) Args() string {
+	if !u.changesUpdater() {
+		return ""
+	}
+	args := []string{}
+	if u.CheckInterval != 0 {
+		args = append(args, "-check-interval", u.CheckInterval.String())
+	}
+	if u.Network != "" {
+		args = append(args, "-network", u.Network)
+	}
+	if u.AutoInstall != "" {
+		args = append(args, "-auto-install", u.AutoInstall)
+	}
+	for i := range args {
+		args[i] = shellQuote(args[i])
+	}
+	return strings.Join(args, " ")
+}
+
+// updaterEdit sets a default of the Updater wherever its sources have it:
+// in preferences or Java constants.  Each pattern captures what comes before
+// and after the value.
+type updaterEdit struct {
+	setting  string
+	patterns []*regexp.Regexp
+}
+
+var (
+	updaterIntervalEdit = updaterEdit{"the check interval", []*regexp.Regexp{
+		regexp.MustCompile(`(\bINTERVAL_MILLIS\s*=\s*)[^;]+(;)`),
+	}}
+	updaterNetworkEdit = updaterEdit{"the default network type", []*regexp.Regexp{
+		regexp.MustCompile(`(\bDEFAULT_NETWORK_TYPE\s*=\s*)[^;]+(;)`),
+		regexp.MustCompile(`(<integer name="network_type_default"[^>]*>)[^<]*(</integer>)`),
+	}}
+	updaterAutoInstallEdit = updaterEdit{"the default of rebooting when idle", []*regexp.Regexp{
+		regexp.MustCompile(`(getBoolean\(\s*(?:Settings\.)?KEY_IDLE_REBOOT\s*,\s*)(?:true|false)(\s*\))`),
+		regexp.MustCompile(`(<bool name="idle_reboot_default"[^>]*>)[^<]*(</bool>)`),
+		regexp.MustCompile(`(android:key="idle_reboot"[^>]*?android:defaultValue=")[^"]*(")`),
+		regexp.MustCompile(`(android:defaultValue=")[^"]*("[^>]*?android:key="idle_reboot")`),
+	}}
+)
+
+// apply sets the value of the edit in the sources, by path, of the Updater
+// given, one value per pattern.  It fails if no source has the setting, so
+// that a change of the Updater upstream does not go unnoticed, and if a
+// pattern matches more than one place, which it cannot tell apart.
+func (e updaterEdit) apply(sources map[string]string, values []string) error {
+	counts := make([]int, len(e.patterns))
+	found := false
+	for _, text := range sources {
+		for i, p := range e.patterns {
+			counts[i] += len(p.FindAllStringIndex(text, -1))
+		}
+	}
+	for i, n := range counts {
+		if n > 1 {
+			return fmt.Errorf("the sources of the Updater have %s in %d places matching %s, not one", e.setting, n, e.patterns[i])
+		}
+		if n == 1 {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("the sources of the Updater do not have %s, which may have changed upstream", e.setting)
+	}
+	for path, text := range sources {
+		for i, p := range e.patterns {
+			text = p.ReplaceAllString(text, "${1}"+strings.Replace(values[i], "$", "$$", -1)+"${2}")
+		}
+		sources[path] = text
+	}
+	return nil
+}
+
+func updaterConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("updater-config", flag.ExitOnError)
+	tree := flags.String("tree", "", "path of the AOSP tree")
+	interval := flags.Duration("check-interval", 0, "interval between checks for updates")
+	network := flags.String("network", "", "network constraint of downloads: any, unmetered or not-roaming")
+	autoInstall := flags.String("auto-install", "", "whether the Updater reboots into installed updates when the device is idle, true or false")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s updater-config -tree <dir> [-check-interval ...] [-network ...] [-auto-install ...]\n\nChanges the defaults of the Updater in packages/apps/Updater of the tree.  Settings not given are left alone.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *tree == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	u, err := newUpdaterConfig("stable", *interval, *network, *autoInstall)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(*tree, "packages", "apps", "Updater")
+	sources := map[string]string{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || (filepath.Ext(p) != ".java" && filepath.Ext(p) != ".xml") {
+			return nil
+		}
+		text, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sources[p] = string(text)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	original := map[string]string{}
+	for p, text := range sources {
+		original[p] = text
+	}
+
+	if u.CheckInterval != 0 {
+		millis := fmt.Sprintf("%dL", u.CheckInterval/time.Millisecond)
+		if err := updaterIntervalEdit.apply(sources, []string{millis}); err != nil {
+			return err
+		}
+	}
+	if u.Network != "" {
+		n := updaterNetworks[u.Network]
+		if err := updaterNetworkEdit.apply(sources, []string{"android.app.job.JobInfo." + n[0], n[1]}); err != nil {
+			return err
+		}
+	}
+	if u.AutoInstall != "" {
+		v := u.AutoInstall
+		if err := updaterAutoInstallEdit.apply(sources, []string{v, v, v, v}); err != nil {
+			return err
+		}
+	}
+
+	paths := []string{}
+	for p := range sources {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		text := sources[p]
+		if text == original[p] {
+			continue
+		}
+		rel, _ := filepath.Rel(*tree, p)
+		fmt.Printf("Changed the Updater defaults in %s\n", rel)
+		if err := writeFileAtomically(p, []byte(text), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	subcommands["updater-config"] = updaterConfigCommand
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The sources of the Updater in testdata/updater are those of
+// packages/apps/Updater that have its defaults, less what does not matter
+// here.
+
+func copyUpdaterSources(t *testing.T) string {
+	t.Helper()
+	tree, err := ioutil.TempDir("", "updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join("testdata", "updater")
+	err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(tree, rel), 0755)
+		}
+		return copyFile(p, filepath.Join(tree, rel))
+	})
+	if err != nil {
+		os.RemoveAll(tree)
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func readUpdaterSource(t *testing.T, tree string, path string) string {
+	t.Helper()
+	text, err := ioutil.ReadFile(filepath.Join(tree, "packages", "apps", "Updater", filepath.FromSlash(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(text)
+}
+
+func TestUpdaterConfig(t *testing.T) {
+	tree := copyUpdaterSources(t)
+	defer os.RemoveAll(tree)
+	err := updaterConfigCommand([]string{"-tree", tree, "-check-interval", "2h", "-network", "unmetered", "-auto-install", "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path, want, setting string
+	}{
+		{"src/app/seamlessupdate/client/PeriodicJob.java", "private static final long INTERVAL_MILLIS = 7200000L;", "the check interval"},
+		{"src/app/seamlessupdate/client/PeriodicJob.java", "private static final long MIN_LATENCY_MILLIS = 4 * 60 * 1000;", "the retry latency"},
+		{"src/app/seamlessupdate/client/Settings.java", "private static final int DEFAULT_NETWORK_TYPE = android.app.job.JobInfo.NETWORK_TYPE_UNMETERED;", "the network type"},
+		{"src/app/seamlessupdate/client/Service.java", "if (preferences.getBoolean(Settings.KEY_IDLE_REBOOT, true)) {", "the default of rebooting when idle"},
+		{"src/app/seamlessupdate/client/Service.java", "preferences.getBoolean(Settings.KEY_WAITING_FOR_REBOOT, false)", "the flag of a pending reboot"},
+		{"res/xml/settings.xml", "android:key=\"idle_reboot\"\n        android:title=\"@string/idle_reboot_title\"\n        android:summary=\"@string/idle_reboot_summary\"\n        android:defaultValue=\"true\" />", "the preference of rebooting when idle"},
+		{"res/xml/settings.xml", "android:key=\"battery_not_low\"\n        android:title=\"@string/battery_not_low_title\"\n        android:summary=\"@string/battery_not_low_summary\"\n        android:defaultValue=\"false\" />", "the preference of a battery not low"},
+	} {
+		if text := readUpdaterSource(t, tree, c.path); !strings.Contains(text, c.want) {
+			t.Errorf("%s of %s is not as expected, missing %q:\n%s", c.setting, c.path, c.want, text)
+		}
+	}
+}
+
+// An edit whose pattern matches more than one place, or none, fails.
+func TestUpdaterEditMatchesOnce(t *testing.T) {
+	sources := map[string]string{
+		"A.java": "static final long INTERVAL_MILLIS = 1;",
+		"B.java": "static final long INTERVAL_MILLIS = 2;",
+	}
+	if err := updaterIntervalEdit.apply(sources, []string{"3L"}); err == nil {
+		t.Errorf("an interval set in two places was changed: %v", sources)
+	}
+	sources = map[string]string{"A.java": "static final long RETRY_INTERVAL_MILLIS = 1;"}
+	if err := updaterIntervalEdit.apply(sources, []string{"3L"}); err == nil {
+		t.Errorf("RETRY_INTERVAL_MILLIS was taken for the check interval: %v", sources)
+	}
+}
+
+// The Updater checks the channel of the property the product sets.
+func TestUpdaterChannelProperty(t *testing.T) {
+	tree := copyUpdaterSources(t)
+	defer os.RemoveAll(tree)
+	if text := readUpdaterSource(t, tree, "src/app/seamlessupdate/client/Service.java"); !strings.Contains(text, `SystemProperties.get("`+updaterChannelProperty+`"`) {
+		t.Errorf("the Updater does not read its channel from %s", updaterChannelProperty)
+	}
+
+	defer func(channel string) { *releaseChannel = channel }(*releaseChannel)
+	*releaseChannel = "beta"
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.CustomProduct.Properties[updaterChannelProperty]; got != "beta" {
+		t.Errorf("%s is %q, not beta", updaterChannelProperty, got)
+	}
+	if config.Updater.Args() != "" {
+		t.Errorf("the channel changes the sources of the Updater: %s", config.Updater.Args())
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// vendorManifestVersion is the version of the vendor manifest file format.
+const vendorManifestVersion = 1
+
+// vendorManifest records the vendor files extracted for a device and AOSP
+// build, so that a partially extracted or damaged tree is not trusted.
+// It is written once extraction succeeds, and replaces the bare flag file
+// that older versions of the build script left behind.
+type vendorManifest struct {
+	Version   int          `json:"version"`
+	Device    string       `json:"device"`
+	Build     string       `json:"build"`
+	Extracted time.Time    `json:"extracted"`
+	Files     []vendorFile `json:"files"`
+}
+
+type vendorFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Link is the target of a symbolic link.
+	Link string `json:"link,omitempty"`
+}
+
+// vendorPaths returns the directory the vendor files of a device and build
+// are extracted to, its manifest and the flag file of older versions.
+func vendorPaths(dir string, device string, build string) (tree string, manifest string, flag string) {
+	return filepath.Join(dir, device, build),
+		filepath.Join(dir, "."+device+"-"+build+".json"),
+		filepath.Join(dir, "."+device+"-"+build)
+}
+
+// scanVendorTree lists and hashes the files in a tree, sorted by path.
+func scanVendorTree(tree string, jobs int) ([]vendorFile, error) {
+	files := []vendorFile{}
+	err := filepath.Walk(tree, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(tree, p)
+		if err != nil {
+			return err
+		}
+		f := vendorFile{Path: rel, Size: info.Size()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if f.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			f.Size = 0
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parallel(len(files), jobs, func(i int) error {
+		if files[i].Link != "" {
+			return nil
+		}
+		sum, _, err := hashFile(filepath.Join(tree, files[i].Path))
+		files[i].SHA256 = sum
+		return err
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+func loadVendorManifest(path string) (*vendorManifest, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &vendorManifest{}
+	if err := json.Unmarshal(contents, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if m.Version > vendorManifestVersion {
+		return nil, fmt.Errorf("%s: vendor manifest version %d is newer than the supported version %d", path, m.Version, vendorManifestVersion)
+	}
+	return m, nil
+}
+
+// vendorMismatches compares the files in a tree with those in its manifest.
+func vendorMismatches(expected []vendorFile, actual []vendorFile) []string {
+	problems := []string{}
+	found := map[string]vendorFile{}
+	for _, f := range actual {
+		found[f.Path] = f
+	}
+	for _, e := range expected {
+		a, ok := found[e.Path]
+		switch {
+		case !ok:
+			problems = append(problems, e.Path+" is missing")
+		case a.Link != e.Link:
+			problems = append(problems, fmt.Sprintf("%s links to %q instead of %q", e.Path, a.Link, e.Link))
+		case a.SHA256 != e.SHA256:
+			problems = append(problems, fmt.Sprintf("%s has sha256 %s instead of %s", e.Path, a.SHA256, e.SHA256))
+		}
+		delete(found, e.Path)
+	}
+	extra := []string{}
+	for p := range found {
+		extra = append(extra, p)
+	}
+	sort.Strings(extra)
+	for _, p := range extra {
+		problems = append(problems, p+" is not in the manifest")
+	}
+	return problems
+}
+
+func vendorRecord(dir string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("vendor record", flag.ExitOnError)
+	device := flags.String("device", "", "device the vendor files are for")
+	build := flags.String("build", "", "AOSP build the vendor files are for (lower case)")
+	flags.Parse(args)
+	if *device == "" || *build == "" {
+		return fmt.Errorf("the -device and -build options are mandatory")
+	}
+
+	tree, manifestPath, flagPath := vendorPaths(dir, *device, *build)
+	files, err := scanVendorTree(tree, jobs)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no vendor files were extracted to %s", tree)
+	}
+	m := &vendorManifest{
+		Version:   vendorManifestVersion,
+		Device:    *device,
+		Build:     *build,
+		Extracted: time.Now().UTC(),
+		Files:     files,
+	}
+	contents, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomically(manifestPath, append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("recorded %d vendor files for %s %s", len(files), *device, *build)
+	if err := os.Remove(flagPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// vendorVerify fails unless the vendor files of the device and build are
+// exactly those recorded in their manifest.
+func vendorVerify(dir string, jobs int, args []string) error {
+	flags := flag.NewFlagSet("vendor verify", flag.ExitOnError)
+	device := flags.String("device", "", "device the vendor files are for")
+	build := flags.String("build", "", "AOSP build the vendor files are for (lower case)")
+	flags.Parse(args)
+	if *device == "" || *build == "" {
+		return fmt.Errorf("the -device and -build options are mandatory")
+	}
+
+	tree, manifestPath, _ := vendorPaths(dir, *device, *build)
+	m, err := loadVendorManifest(manifestPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no manifest of vendor files for %s %s", *device, *build)
+	}
+	if err != nil {
+		return err
+	}
+	files, err := scanVendorTree(tree, jobs)
+	if err != nil {
+		return err
+	}
+	problems := vendorMismatches(m.Files, files)
+	if len(problems) == 0 {
+		log.Printf("verified %d vendor files for %s %s", len(files), *device, *build)
+		return nil
+	}
+	const shown = 20
+	for i, p := range problems {
+		if i == shown {
+			log.Printf("... and %d more problems", len(problems)-shown)
+			break
+		}
+		log.Printf("%s", p)
+	}
+	return fmt.Errorf("vendor files for %s %s do not match their manifest", *device, *build)
+}
+
+// vendorPrune removes the vendor files of all builds of a device but the
+// current one and the most recently extracted others, kept for rollback.
+func vendorPrune(dir string, args []string) error {
+	flags := flag.NewFlagSet("vendor prune", flag.ExitOnError)
+	device := flags.String("device", "", "device the vendor files are for")
+	current := flags.String("current", "", "AOSP build (lower case) whose vendor files are in use")
+	keep := flags.Int("keep", 1, "number of builds kept besides the current one")
+	flags.Parse(args)
+	if *device == "" {
+		return fmt.Errorf("the -device option is mandatory")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, *device))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	builds := []string{}
+	extracted := map[string]time.Time{}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == *current {
+			continue
+		}
+		builds = append(builds, e.Name())
+		// Trees without a manifest are incomplete, and go first.
+		_, manifestPath, _ := vendorPaths(dir, *device, e.Name())
+		if m, err := loadVendorManifest(manifestPath); err == nil {
+			extracted[e.Name()] = m.Extracted
+		}
+	}
+	sort.SliceStable(builds, func(i, j int) bool {
+		return extracted[builds[i]].After(extracted[builds[j]])
+	})
+	for i, build := range builds {
+		if i < *keep && !extracted[build].IsZero() {
+			continue
+		}
+		log.Printf("removing vendor files for %s %s", *device, build)
+		tree, manifestPath, flagPath := vendorPaths(dir, *device, build)
+		for _, p := range []string{manifestPath, flagPath, tree} {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func vendorCommand(args []string) error {
+	flags := flag.NewFlagSet("vendor", flag.ExitOnError)
+	dir := flags.String("dir", "vendor-in", "directory vendor files are extracted to")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "number of files to hash in parallel")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s vendor [-dir vendor-in] <record|verify|prune> [options]\n\nKeeps track of the integrity of extracted vendor files.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "record":
+		return vendorRecord(*dir, *jobs, rest)
+	case "verify":
+		return vendorVerify(*dir, *jobs, rest)
+	case "prune":
+		return vendorPrune(*dir, rest)
+	}
+	return fmt.Errorf("unknown vendor subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["vendor"] = vendorCommand
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Outcomes of the verification of a source, from best to worst.
+const (
+	verifyVerified  = "verified"
+	verifyUnsigned  = "unsigned"
+	verifyUntrusted = "untrusted"
+	verifyMissing   = "missing"
+	verifyBad       = "bad"
+)
+
+var verifySeverity = map[string]int{
+	verifyVerified:  0,
+	verifyUnsigned:  1,
+	verifyUntrusted: 2,
+	verifyMissing:   3,
+	verifyBad:       4,
+}
+
+// verificationResult is one line of the verification report, which the
+// build script appends to as it verifies the sources each stage fetches.
+type verificationResult struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Name   string    `json:"name"`
+	Dir    string    `json:"dir"`
+	Kind   string    `json:"kind"`
+	Ref    string    `json:"ref"`
+	Status string    `json:"status"`
+	// Signer is the fingerprint of the key that made a good signature.
+	Signer string `json:"signer,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r verificationResult) String() string {
+	s := fmt.Sprintf("%-9s %s %s %s", r.Status, r.Name, r.Kind, r.Ref)
+	if r.Signer != "" {
+		s += ", signed by " + r.Signer
+	}
+	if r.Detail != "" {
+		s += " (" + r.Detail + ")"
+	}
+	return s
+}
+
+// keyring is a temporary GnuPG home with the trusted keys imported, so
+// that signatures by any other key do not verify.
+type keyring struct {
+	home string
+}
+
+// newKeyring imports the keys in path, which is a key file or a directory
+// of them (such as gpgkeys/ in this project).
+func newKeyring(path string) (*keyring, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = []string{}
+		for _, i := range infos {
+			if i.Mode().IsRegular() {
+				files = append(files, filepath.Join(path, i.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("there are no keys in %s", path)
+		}
+	}
+	home, err := ioutil.TempDir("", "keyring.")
+	if err != nil {
+		return nil, err
+	}
+	k := &keyring{home}
+	cmd := exec.Command("gpg", append([]string{"--batch", "--quiet", "--homedir", home, "--import"}, files...)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		k.close()
+		return nil, fmt.Errorf("importing the keys in %s: %v", path, err)
+	}
+	return k, nil
+}
+
+func (k *keyring) close() {
+	os.RemoveAll(k.home)
+}
+
+// verify checks the signature of a tag or commit in a git checkout.
+func (k *keyring) verify(dir string, kind string, ref string) (status string, signer string, detail string) {
+	if err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", ref+"^{}").Run(); err != nil {
+		return verifyMissing, "", fmt.Sprintf("no %s %s in %s", kind, ref, dir)
+	}
+	cmd := exec.Command("git", "-C", dir, "verify-"+kind, "--raw", ref)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+k.home)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	status = verifyUnsigned
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimPrefix(scanner.Text(), "[GNUPG:] "))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "VALIDSIG":
+			if len(fields) > 1 {
+				signer = fields[1]
+			}
+		case "BADSIG":
+			return verifyBad, "", "the signature does not match"
+		case "ERRSIG", "NO_PUBKEY":
+			status = verifyUntrusted
+			detail = "signed by a key not in the keyring"
+		}
+	}
+	if err == nil && signer != "" {
+		return verifyVerified, signer, ""
+	}
+	return status, "", detail
+}
+
+// verifyHead verifies the tags that point at the HEAD of a checkout, and
+// its commit, and returns the best outcome.  Any bad signature wins.
+func (k *keyring) verifyHead(dir string) (kind string, ref string, status string, signer string, detail string) {
+	kind, ref = "commit", "HEAD"
+	status, signer, detail = k.verify(dir, kind, ref)
+	out, err := exec.Command("git", "-C", dir, "tag", "--points-at", "HEAD").Output()
+	if err != nil {
+		return
+	}
+	for _, tag := range strings.Fields(string(out)) {
+		s, sg, d := k.verify(dir, "tag", tag)
+		if s == verifyBad || (status != verifyBad && verifySeverity[s] < verifySeverity[status]) {
+			kind, ref, status, signer, detail = "tag", tag, s, sg, d
+		}
+	}
+	return
+}
+
+func loadVerificationReport(path string) ([]verificationResult, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results := []verificationResult{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		r := verificationResult{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		results = append(results, r)
+	}
+	return results, scanner.Err()
+}
+
+func appendVerificationResult(path string, r verificationResult) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// verifyCheck verifies a source and records the outcome in the report.
+// Under the enforce policy, anything short of a good signature by a key
+// in the keyring is an error; under the warn policy, it is only logged.
+func verifyCheck(keyringPath string, policy string, report string, args []string) error {
+	flags := flag.NewFlagSet("verify check", flag.ExitOnError)
+	stage := flags.String("stage", "", "build stage that fetched the source")
+	name := flags.String("name", "", "name of the source in the report")
+	dir := flags.String("dir", ".", "git checkout of the source")
+	tag := flags.String("tag", "", "tag to verify")
+	commit := flags.String("commit", "", "commit to verify")
+	flags.Parse(args)
+	if keyringPath == "" {
+		return fmt.Errorf("the -keyring option is mandatory")
+	}
+	if *tag != "" && *commit != "" {
+		return fmt.Errorf("the -tag and -commit options are mutually exclusive")
+	}
+	if *name == "" {
+		*name = *dir
+	}
+
+	k, err := newKeyring(keyringPath)
+	if err != nil {
+		return err
+	}
+	defer k.close()
+	r := verificationResult{Time: time.Now().UTC(), Stage: *stage, Name: *name, Dir: *dir}
+	switch {
+	case *tag != "":
+		r.Kind, r.Ref = "tag", *tag
+		r.Status, r.Signer, r.Detail = k.verify(*dir, r.Kind, r.Ref)
+	case *commit != "":
+		r.Kind, r.Ref = "commit", *commit
+		r.Status, r.Signer, r.Detail = k.verify(*dir, r.Kind, r.Ref)
+	default:
+		r.Kind, r.Ref, r.Status, r.Signer, r.Detail = k.verifyHead(*dir)
+	}
+	if report != "" {
+		if err := appendVerificationResult(report, r); err != nil {
+			return err
+		}
+	}
+	if r.Status == verifyVerified {
+		log.Printf("%s", r)
+		return nil
+	}
+	if policy == "enforce" {
+		return fmt.Errorf("%s", r)
+	}
+	log.Printf("warning: %s", r)
+	return nil
+}
+
+func showVerificationReport(w io.Writer, results []verificationResult, stage string) {
+	stages := []string{}
+	byStage := map[string][]verificationResult{}
+	for _, r := range results {
+		if stage != "" && r.Stage != stage {
+			continue
+		}
+		if _, ok := byStage[r.Stage]; !ok {
+			stages = append(stages, r.Stage)
+		}
+		byStage[r.Stage] = append(byStage[r.Stage], r)
+	}
+	for _, s := range stages {
+		failed := 0
+		for _, r := range byStage[s] {
+			if r.Status != verifyVerified {
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "Verification of the sources of stage %s: %d verified, %d not verified\n", s, len(byStage[s])-failed, failed)
+		for _, r := range byStage[s] {
+			fmt.Fprintf(w, "  %s\n", r)
+		}
+	}
+}
+
+func verifyShow(report string, args []string) error {
+	flags := flag.NewFlagSet("verify show", flag.ExitOnError)
+	stage := flags.String("stage", "", "only show the sources of this stage")
+	flags.Parse(args)
+	if report == "" {
+		return fmt.Errorf("the -report option is mandatory")
+	}
+	results, err := loadVerificationReport(report)
+	if err != nil {
+		return err
+	}
+	showVerificationReport(os.Stdout, results, *stage)
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyringPath := flags.String("keyring", "", "file, or directory of files, with the trusted public keys")
+	policy := flags.String("policy", "warn", "what to do with sources that do not verify: warn or enforce (fail)")
+	report := flags.String("report", "", "path to the verification report (JSON lines)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [options] <check|show> [options]\n\nVerifies the signatures of tags and commits of fetched sources.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *policy != "warn" && *policy != "enforce" {
+		return fmt.Errorf("unknown verification policy %q", *policy)
+	}
+	rest := flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "check":
+		return verifyCheck(*keyringPath, *policy, *report, rest)
+	case "show":
+		return verifyShow(*report, rest)
+	}
+	return fmt.Errorf("unknown verify subcommand %q", flags.Arg(0))
+}
+
+func init() {
+	subcommands["verify"] = verifyCommand
+}
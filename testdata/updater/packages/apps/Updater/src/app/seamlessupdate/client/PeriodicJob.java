@@ -0,0 +1,54 @@
+package app.seamlessupdate.client;
+
+import android.app.job.JobInfo;
+import android.app.job.JobParameters;
+import android.app.job.JobScheduler;
+import android.app.job.JobService;
+import android.content.ComponentName;
+import android.content.Context;
+import android.util.Log;
+
+public class PeriodicJob extends JobService {
+    private static final String TAG = "PeriodicJob";
+    private static final int JOB_ID_PERIODIC = 1;
+    private static final int JOB_ID_RETRY = 2;
+    private static final long INTERVAL_MILLIS = 4 * 60 * 60 * 1000;
+    private static final long MIN_LATENCY_MILLIS = 4 * 60 * 1000;
+
+    static void schedule(final Context context) {
+        final int networkType = Settings.getNetworkType(context);
+        final boolean batteryNotLow = Settings.getBatteryNotLow(context);
+        final JobScheduler scheduler = context.getSystemService(JobScheduler.class);
+        final JobInfo jobInfo = scheduler.getPendingJob(JOB_ID_PERIODIC);
+        if (jobInfo != null &&
+                jobInfo.getNetworkType() == networkType &&
+                jobInfo.isRequireBatteryNotLow() == batteryNotLow &&
+                jobInfo.isPersisted() &&
+                jobInfo.getIntervalMillis() == INTERVAL_MILLIS) {
+            Log.d(TAG, "Periodic job already registered");
+            return;
+        }
+        final ComponentName serviceName = new ComponentName(context, PeriodicJob.class);
+        final int result = scheduler.schedule(new JobInfo.Builder(JOB_ID_PERIODIC, serviceName)
+            .setRequiredNetworkType(networkType)
+            .setRequiresBatteryNotLow(batteryNotLow)
+            .setPersisted(true)
+            .setPeriodic(INTERVAL_MILLIS)
+            .build());
+        if (result == JobScheduler.RESULT_FAILURE) {
+            Log.d(TAG, "Periodic job schedule failed");
+        }
+    }
+
+    static void scheduleRetry(final Context context) {
+        final ComponentName serviceName = new ComponentName(context, PeriodicJob.class);
+        final int result = context.getSystemService(JobScheduler.class).schedule(new JobInfo.Builder(JOB_ID_RETRY, serviceName)
+            .setRequiredNetworkType(Settings.getNetworkType(context))
+            .setRequiresBatteryNotLow(Settings.getBatteryNotLow(context))
+            .setMinimumLatency(MIN_LATENCY_MILLIS)
+            .build());
+        if (result == JobScheduler.RESULT_FAILURE) {
+            Log.d(TAG, "Retry job schedule failed");
+        }
+    }
+}
@@ -0,0 +1,33 @@
+package app.seamlessupdate.client;
+
+import android.app.IntentService;
+import android.content.Intent;
+import android.content.SharedPreferences;
+import android.os.SystemProperties;
+
+public class Service extends IntentService {
+    private static final String TAG = "Service";
+
+    public Service() {
+        super(TAG);
+    }
+
+    @Override
+    protected void onHandleIntent(final Intent intent) {
+        final SharedPreferences preferences = Settings.getPreferences(this);
+        if (preferences.getBoolean(Settings.KEY_WAITING_FOR_REBOOT, false)) {
+            return;
+        }
+        final String channel = SystemProperties.get("sys.update.channel",
+            preferences.getString(Settings.KEY_CHANNEL, "stable"));
+        final String device = SystemProperties.get("ro.product.device");
+        final String url = getString(R.string.url) + device + "-" + channel;
+
+        // The update is fetched, verified and installed from url here.
+
+        preferences.edit().putBoolean(Settings.KEY_WAITING_FOR_REBOOT, true).commit();
+        if (preferences.getBoolean(Settings.KEY_IDLE_REBOOT, false)) {
+            IdleReboot.schedule(this);
+        }
+    }
+}